@@ -4,6 +4,9 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"math"
+	"sort"
+	"strconv"
 )
 
 type BType uint8
@@ -16,6 +19,20 @@ const (
 	BDICT
 )
 
+func (t BType) String() string {
+	switch t {
+	case BSTR:
+		return "string"
+	case BINT:
+		return "int"
+	case BLIST:
+		return "list"
+	case BDICT:
+		return "dict"
+	}
+	return "BType(" + strconv.Itoa(int(t)) + ")"
+}
+
 var (
 	ErrNum = errors.New("expect num")
 	ErrCol = errors.New("expect colon")
@@ -23,11 +40,32 @@ var (
 	ErrEpE = errors.New("expect 'e'")
 	ErrTyp = errors.New("wrong type")
 	ErrIvd = errors.New("invalid bencode")
+	ErrOrd = errors.New("dict keys not sorted")
+	ErrDup = errors.New("duplicate dict key")
+	ErrReq = errors.New("missing required key")
+	ErrLen = errors.New("string too long")
+	ErrDep = errors.New("nesting too deep")
+	ErrBig = errors.New("value too large")
+	ErrOvf = errors.New("integer overflow")
+	ErrLdz = errors.New("leading zero")
+	ErrNeg = errors.New("negative zero")
+	ErrPth = errors.New("path not found")
 )
 
+// DecodeOptions restricts what the parser accepts, to protect against
+// malicious or broken input. A zero limit means no limit.
+type DecodeOptions struct {
+	MaxStringLen int   // longest string accepted
+	MaxDepth     int   // deepest nesting of lists and dicts
+	MaxSize      int64 // most bytes a single top-level value may take
+	StrictInts   bool  // reject leading zeros and "-0" in integers and lengths
+	SortedKeys   bool  // reject unsorted or duplicate dict keys
+}
+
 type BObject struct {
 	typ_ BType
 	val_ BValue
+	raw_ []byte
 }
 
 func (o *BObject) Str() (string, error) {
@@ -44,92 +82,255 @@ func (o *BObject) Int() (int, error) {
 	return o.val_.(int), nil
 }
 
+// List returns a copy of the items of a list, edit them with the setters
 func (o *BObject) List() ([]*BObject, error) {
+	list, err := o.items()
+	if err != nil {
+		return nil, err
+	}
+	return append(make([]*BObject, 0, len(list)), list...), nil
+}
+
+// Dict returns a copy of the entries of a dict, edit them with the setters
+func (o *BObject) Dict() (map[string]*BObject, error) {
+	dict, err := o.entries()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*BObject, len(dict))
+	for key, val := range dict {
+		res[key] = val
+	}
+	return res, nil
+}
+
+// items returns the items of a list themselves, only the setters edit them
+func (o *BObject) items() ([]*BObject, error) {
 	if o.typ_ != BLIST {
 		return nil, ErrTyp
 	}
 	return o.val_.([]*BObject), nil
 }
 
-func (o *BObject) Dict() (map[string]*BObject, error) {
+// entries returns the entries of a dict themselves, only the setters edit them
+func (o *BObject) entries() (map[string]*BObject, error) {
 	if o.typ_ != BDICT {
 		return nil, ErrTyp
 	}
 	return o.val_.(map[string]*BObject), nil
 }
 
-func (o *BObject) Bencode(w io.Writer) int {
-	bw, ok := w.(*bufio.Writer)
-	if !ok {
-		bw = bufio.NewWriter(w)
+// Raw returns the exact bytes the object was parsed from, or nil if the
+// object was not produced by Parse, or was edited since: itself or any
+// object it contains.
+func (o *BObject) Raw() []byte {
+	if !o.intact() {
+		return nil
+	}
+	return o.raw_
+}
+
+// intact tells if o and the objects it contains are as Parse returned them.
+// The setters drop the raw bytes of the object they edit, so an edit deep
+// down shows as a missing raw somewhere below o.
+func (o *BObject) intact() bool {
+	if o.raw_ == nil {
+		return false
 	}
-	wLen := 0
 	switch o.typ_ {
-	case BSTR:
-		str, _ := o.Str()
-		wLen += EncodeString(bw, str)
-	case BINT:
-		num, _ := o.Int()
-		wLen += EncodeInt(bw, num)
 	case BLIST:
-		_ = bw.WriteByte('l')
-		list, _ := o.List()
-		for _, obj := range list {
-			wLen += obj.Bencode(bw)
+		for _, item := range o.val_.([]*BObject) {
+			if !item.intact() {
+				return false
+			}
 		}
-		_ = bw.WriteByte('e')
-		wLen += 2
 	case BDICT:
-		_ = bw.WriteByte('d')
-		dict, _ := o.Dict()
-		for key, obj := range dict {
-			wLen += EncodeString(bw, key)
-			wLen += obj.Bencode(bw)
+		for _, item := range o.val_.(map[string]*BObject) {
+			if !item.intact() {
+				return false
+			}
 		}
-		_ = bw.WriteByte('e')
-		wLen += 2
 	}
-	_ = bw.Flush()
-	return wLen
+	return true
+}
+
+// Bencode writes o to w and returns the number of bytes written, or 0 if
+// writing failed. Use Encoder to get hold of the error.
+func (o *BObject) Bencode(w io.Writer) int {
+	e := newEncoder(w)
+	e.object(o)
+	e.flush()
+	if e.err != nil {
+		return 0
+	}
+	return e.n
+}
+
+// sortedKeys returns the keys of dict in raw byte order, which is the
+// order bencoded dictionaries must be written in.
+func sortedKeys(dict map[string]*BObject) []string {
+	keys := make([]string, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func Parse(r io.Reader) (*BObject, error) {
+	return newParser(r).parseValue()
+}
+
+// ParseStrict is like Parse, but only accepts canonical bencode as the spec
+// requires: dict keys sorted and unique, and no leading zeros or "-0".
+func ParseStrict(r io.Reader) (*BObject, error) {
+	p := newParser(r)
+	p.opts = DecodeOptions{StrictInts: true, SortedKeys: true}
+	return p.parseValue()
+}
+
+// parser reads bencoded values from br and keeps a copy of every consumed
+// byte, so that each parsed BObject can refer to its exact raw encoding.
+type parser struct {
+	br    *bufio.Reader
+	buf   []byte
+	base  int64 // offset of buf[0] in the input stream
+	depth int
+	opts  DecodeOptions
+}
+
+func newParser(r io.Reader) *parser {
 	br, ok := r.(*bufio.Reader)
 	if !ok {
 		br = bufio.NewReader(r)
 	}
-	bn, err := br.Peek(1)
+	return &parser{br: br}
+}
+
+// offset returns the number of bytes of the input consumed so far
+func (p *parser) offset() int64 {
+	return p.base + int64(len(p.buf))
+}
+
+// unexpectedEOF turns io.EOF met in the middle of a value into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (p *parser) readByte() (byte, error) {
+	if p.opts.MaxSize > 0 && int64(len(p.buf)) >= p.opts.MaxSize {
+		return 0, ErrBig
+	}
+	b, err := p.br.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	p.buf = append(p.buf, b)
+	return b, nil
+}
+
+func (p *parser) unreadByte() {
+	_ = p.br.UnreadByte()
+	p.buf = p.buf[:len(p.buf)-1]
+}
+
+func (p *parser) peekByte() (byte, error) {
+	bn, err := p.br.Peek(1)
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return bn[0], nil
+}
+
+// readChunk is how much readFull allocates at a time, so a forged length
+// can't make us allocate more than the input really holds
+const readChunk = 64 << 10
+
+func (p *parser) readFull(n int) ([]byte, error) {
+	if p.opts.MaxSize > 0 && int64(len(p.buf))+int64(n) > p.opts.MaxSize {
+		return nil, ErrBig
+	}
+	start := len(p.buf)
+	for read := 0; read < n; {
+		chunk := n - read
+		if chunk > readChunk {
+			chunk = readChunk
+		}
+		p.buf = append(p.buf, make([]byte, chunk)...)
+		m, err := io.ReadFull(p.br, p.buf[start+read:])
+		read += m
+		if err != nil {
+			p.buf = p.buf[:start+read]
+			return nil, unexpectedEOF(err)
+		}
+	}
+	return p.buf[start:], nil
+}
+
+// parseValue parses a single top-level value. It returns io.EOF if the input
+// ends before the value starts, and a *DecodeError for any other failure.
+func (p *parser) parseValue() (*BObject, error) {
+	if _, err := p.br.Peek(1); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, &DecodeError{Offset: p.offset(), Err: err}
+	}
+	o, err := p.parse()
+	if err != nil {
+		return nil, &DecodeError{Offset: p.offset(), Err: err}
+	}
+	return o, nil
+}
+
+func (p *parser) parse() (*BObject, error) {
+	b, err := p.peekByte()
 	if err != nil {
 		return nil, err
 	}
-	b := bn[0]
+	start := len(p.buf)
 	bo := &BObject{}
 	switch {
 	case checkNum(b):
 		// parse str
 		bo.typ_ = BSTR
-		bo.val_, err = DecodeString(br)
+		bo.val_, err = p.decodeString()
 		if err != nil {
 			return nil, err
 		}
 	case b == 'i':
 		// parse int
 		bo.typ_ = BINT
-		bo.val_, err = DecodeInt(br)
+		bo.val_, err = p.decodeInt()
 		if err != nil {
 			return nil, err
 		}
 	case b == 'l':
 		// parse list
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
 		bo.typ_ = BLIST
 		var list []*BObject
-		_, _ = br.ReadByte()
+		if _, err := p.readByte(); err != nil {
+			return nil, err
+		}
 		for {
-			if p, _ := br.Peek(1); p[0] == 'e' {
-				_, _ = br.ReadByte()
+			b, err := p.peekByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == 'e' {
+				if _, err := p.readByte(); err != nil {
+					return nil, err
+				}
 				break
 			}
-			item, err := Parse(br)
+			item, err := p.parse()
 			if err != nil {
 				return nil, err
 			}
@@ -138,19 +339,41 @@ func Parse(r io.Reader) (*BObject, error) {
 		bo.val_ = list
 	case b == 'd':
 		// parse dict
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
 		bo.typ_ = BDICT
 		bMap := make(map[string]*BObject)
-		_, _ = br.ReadByte()
+		if _, err := p.readByte(); err != nil {
+			return nil, err
+		}
+		lastKey := ""
 		for {
-			if p, _ := br.Peek(1); p[0] == 'e' {
-				_, _ = br.ReadByte()
+			b, err := p.peekByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == 'e' {
+				if _, err := p.readByte(); err != nil {
+					return nil, err
+				}
 				break
 			}
-			key, err := DecodeString(br)
+			key, err := p.decodeString()
 			if err != nil {
 				return nil, err
 			}
-			val, err := Parse(br)
+			if p.opts.SortedKeys && len(bMap) > 0 {
+				if key == lastKey {
+					return nil, ErrDup
+				}
+				if key < lastKey {
+					return nil, ErrOrd
+				}
+			}
+			lastKey = key
+			val, err := p.parse()
 			if err != nil {
 				return nil, err
 			}
@@ -160,6 +383,8 @@ func Parse(r io.Reader) (*BObject, error) {
 	default:
 		return nil, ErrIvd
 	}
+	end := len(p.buf)
+	bo.raw_ = p.buf[start:end:end]
 	return bo, nil
 }
 
@@ -167,124 +392,149 @@ func checkNum(data byte) bool {
 	return data >= '0' && data <= '9'
 }
 
-func readDecimal(r *bufio.Reader) (val, len int) {
-	sign := 1
-	b, _ := r.ReadByte()
-	len++
-	if b == '-' {
-		sign = -1
-		b, _ = r.ReadByte()
-		len++
-	}
-	for {
-		if !checkNum(b) {
-			_ = r.UnreadByte()
-			len--
-			return sign * val, len
-		}
-		val = val*10 + int(b-'0')
-		b, _ = r.ReadByte()
-		len++
+// enter and leave track the nesting depth of lists and dicts
+func (p *parser) enter() error {
+	p.depth++
+	if p.opts.MaxDepth > 0 && p.depth > p.opts.MaxDepth {
+		return ErrDep
 	}
+	return nil
 }
 
-func writeDecimal(w *bufio.Writer, val int) (len int) {
-	if val == 0 {
-		_ = w.WriteByte('0')
-		len++
-		return
+func (p *parser) leave() {
+	p.depth--
+}
+
+// readDecimal reads a decimal number, with an optional '-' sign if signed is set.
+// Numbers that don't fit in an int are rejected.
+func (p *parser) readDecimal(signed bool) (int, error) {
+	b, err := p.readByte()
+	if err != nil {
+		return 0, err
 	}
-	if val < 0 {
-		_ = w.WriteByte('-')
-		len++
-		val *= -1
+	neg := false
+	if signed && b == '-' {
+		neg = true
+		b, err = p.readByte()
+		if err != nil {
+			return 0, err
+		}
 	}
-
-	dividend := 1
-	for {
-		if dividend > val {
-			dividend /= 10
-			break
+	limit := uint64(math.MaxInt)
+	if neg {
+		limit++
+	}
+	first := b
+	var val uint64
+	digits := 0
+	for checkNum(b) {
+		d := uint64(b - '0')
+		if val > (limit-d)/10 {
+			return 0, ErrOvf
+		}
+		val = val*10 + d
+		digits++
+		b, err = p.readByte()
+		if err != nil {
+			return 0, err
 		}
-		dividend *= 10
 	}
-	for {
-		_ = w.WriteByte(byte(val/dividend) + '0')
-		len++
-		if dividend == 1 {
-			return
+	p.unreadByte()
+	if digits == 0 {
+		return 0, ErrNum
+	}
+	if p.opts.StrictInts {
+		if digits > 1 && first == '0' {
+			return 0, ErrLdz
 		}
-		val %= dividend
-		dividend /= 10
+		if neg && val == 0 {
+			return 0, ErrNeg
+		}
+	}
+	if neg {
+		return -int(val-1) - 1, nil
 	}
+	return int(val), nil
+}
+
+// appendString appends the bencoding of val to buf
+func appendString(buf []byte, val string) []byte {
+	buf = strconv.AppendInt(buf, int64(len(val)), 10)
+	buf = append(buf, ':')
+	return append(buf, val...)
+}
+
+// appendInt appends the bencoding of val to buf
+func appendInt(buf []byte, val int64) []byte {
+	buf = append(buf, 'i')
+	buf = strconv.AppendInt(buf, val, 10)
+	return append(buf, 'e')
 }
 
 func EncodeString(w io.Writer, val string) int {
-	strLen := len(val)
-	bw := bufio.NewWriter(w)
-	wLen := writeDecimal(bw, strLen)
-	_ = bw.WriteByte(':')
-	wLen++
-	_, _ = bw.WriteString(val)
-	wLen += strLen
-
-	err := bw.Flush()
+	n, err := w.Write(appendString(nil, val))
 	if err != nil {
 		return 0
 	}
-	return wLen
+	return n
 }
 
 func DecodeString(r io.Reader) (string, error) {
-	str := ""
-	br, ok := r.(*bufio.Reader)
-	if !ok {
-		br = bufio.NewReader(r)
+	return newParser(r).decodeString()
+}
+
+func (p *parser) decodeString() (string, error) {
+	strLen, err := p.readDecimal(false)
+	if err != nil {
+		return "", err
 	}
-	strLen, nLen := readDecimal(br)
-	if nLen == 0 {
-		return str, ErrNum
+	if p.opts.MaxStringLen > 0 && strLen > p.opts.MaxStringLen {
+		return "", ErrLen
+	}
+	b, err := p.readByte()
+	if err != nil {
+		return "", err
 	}
-	b, err := br.ReadByte()
 	if b != ':' {
-		return str, ErrCol
+		return "", ErrCol
 	}
-	buf := make([]byte, strLen)
-	_, err = io.ReadAtLeast(br, buf, strLen)
-	str = string(buf)
-	return str, err
+	buf, err := p.readFull(strLen)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
 }
 
 func EncodeInt(w io.Writer, val int) int {
-	bw := bufio.NewWriter(w)
-	wLen := 0
-	_ = bw.WriteByte('i')
-	wLen++
-	nLen := writeDecimal(bw, val)
-	wLen += nLen
-	_ = bw.WriteByte('e')
-	wLen++
-
-	err := bw.Flush()
+	n, err := w.Write(appendInt(nil, int64(val)))
 	if err != nil {
 		return 0
 	}
-	return wLen
+	return n
 }
 
 func DecodeInt(r io.Reader) (int, error) {
-	br, ok := r.(*bufio.Reader)
-	if !ok {
-		br = bufio.NewReader(r)
+	return newParser(r).decodeInt()
+}
+
+func (p *parser) decodeInt() (int, error) {
+	b, err := p.readByte()
+	if err != nil {
+		return 0, err
 	}
-	b, err := br.ReadByte()
 	if b != 'i' {
 		return 0, ErrEpI
 	}
-	val, _ := readDecimal(br)
-	b, err = br.ReadByte()
+	val, err := p.readDecimal(true)
+	if err != nil {
+		return 0, err
+	}
+	b, err = p.readByte()
+	if err != nil {
+		return val, err
+	}
 	if b != 'e' {
 		return val, ErrEpE
 	}
-	return val, err
+	return val, nil
 }
@@ -136,6 +136,7 @@ func TestParseMap(t *testing.T) {
 
 	out := bytes.NewBufferString("")
 	assert.Equal(t, len(in), o.Bencode(out))
+	assert.Equal(t, "d3:agei29e4:name6:archere", out.String())
 }
 
 func TestParseComMap(t *testing.T) {
@@ -150,3 +151,121 @@ func TestParseComMap(t *testing.T) {
 	assert.Equal(t, BDICT, dict["user"].typ_)
 	assert.Equal(t, BLIST, dict["value"].typ_)
 }
+
+func TestParseRaw(t *testing.T) {
+	in := "d4:infod4:name6:archer7:privatei1ee3:tagli1ei2eee"
+	o, err := Parse(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, in, string(o.Raw()))
+	dict, _ := o.Dict()
+	assert.Equal(t, "d4:name6:archer7:privatei1ee", string(dict["info"].Raw()))
+	assert.Equal(t, "li1ei2ee", string(dict["tag"].Raw()))
+	list, _ := dict["tag"].List()
+	assert.Equal(t, "i2e", string(list[1].Raw()))
+}
+
+func TestBencodeSortedKeys(t *testing.T) {
+	in := "d1:bi2e1:ai1e2:aai3e1:Bd1:zi0e1:yi0eee"
+	expect := "d1:Bd1:yi0e1:zi0ee1:ai1e2:aai3e1:bi2ee"
+	o, err := Parse(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+	for i := 0; i < 10; i++ {
+		out := new(bytes.Buffer)
+		o.Bencode(out)
+		assert.Equal(t, expect, out.String())
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	_, err := ParseStrict(bytes.NewBufferString("d1:ai1e1:bi2ee"))
+	assert.Equal(t, nil, err)
+	_, err = ParseStrict(bytes.NewBufferString("d1:bi2e1:ai1ee"))
+	assert.ErrorIs(t, err, ErrOrd)
+	_, err = ParseStrict(bytes.NewBufferString("d1:ai1e1:ai2ee"))
+	assert.ErrorIs(t, err, ErrDup)
+	_, err = ParseStrict(bytes.NewBufferString("ld1:ai1eed1:ci1e1:bi2eee"))
+	assert.ErrorIs(t, err, ErrOrd)
+
+	// unsorted keys are still accepted by the lenient parser
+	_, err = Parse(bytes.NewBufferString("d1:bi2e1:ai1ee"))
+	assert.Equal(t, nil, err)
+}
+
+func TestBuildObject(t *testing.T) {
+	files := NewList(NewDict(map[string]*BObject{
+		"length": NewInt(3),
+		"path":   NewList(NewString("a"), NewString("b.txt")),
+	}))
+	info := NewDict(nil)
+	assert.Equal(t, nil, info.Set("name", NewString("dir")))
+	assert.Equal(t, nil, info.Set("files", files))
+	root := NewDict(map[string]*BObject{"info": info})
+	assert.Equal(t, BDICT, root.Type())
+
+	buf := new(bytes.Buffer)
+	root.Bencode(buf)
+	assert.Equal(t, "d4:infod5:filesld6:lengthi3e4:pathl1:a5:b.txteee4:name3:diree", buf.String())
+
+	assert.Equal(t, nil, files.Append(NewDict(nil)))
+	assert.Equal(t, nil, files.SetIndex(1, NewString("x")))
+	assert.ErrorIs(t, files.SetIndex(2, NewInt(0)), ErrPth)
+	assert.ErrorIs(t, files.Set("k", NewInt(0)), ErrTyp)
+	assert.Equal(t, nil, info.Delete("files"))
+	buf.Reset()
+	root.Bencode(buf)
+	assert.Equal(t, "d4:infod4:name3:diree", buf.String())
+}
+
+func TestGetPath(t *testing.T) {
+	in := "d4:infod5:filesld6:lengthi3e4:pathl1:a5:b.txteee4:name3:diree"
+	o, err := Parse(bytes.NewBufferString(in))
+	assert.Equal(t, nil, err)
+
+	name, err := o.Get("info", "files", 0, "path", 1)
+	assert.Equal(t, nil, err)
+	str, _ := name.Str()
+	assert.Equal(t, "b.txt", str)
+	self, _ := o.Get()
+	assert.Equal(t, o, self)
+
+	_, err = o.Get("info", "pieces")
+	assert.ErrorIs(t, err, ErrPth)
+	_, err = o.Get("info", "files", 1)
+	assert.ErrorIs(t, err, ErrPth)
+	_, err = o.Get("info", "name", 0)
+	assert.ErrorIs(t, err, ErrTyp)
+	_, err = o.Get(1.5)
+	assert.ErrorIs(t, err, ErrPth)
+
+	// the lists and dicts returned are copies, editing them changes nothing
+	dict, _ := o.Dict()
+	delete(dict, "info")
+	files, _ := o.Get("info", "files")
+	list, _ := files.List()
+	list[0] = NewInt(1)
+	assert.Equal(t, in, string(o.Raw()))
+
+	// edits drop the raw bytes of the edited object and of its containers
+	name.SetInt(7)
+	assert.Equal(t, BINT, name.Type())
+	assert.Equal(t, []byte(nil), name.Raw())
+	info, _ := o.Get("info")
+	assert.Equal(t, []byte(nil), info.Raw())
+	assert.Equal(t, []byte(nil), o.Raw())
+	length, _ := o.Get("info", "files", 0, "length")
+	assert.Equal(t, "i3e", string(length.Raw()))
+	// which are encoded again, e.g. for an Unmarshaler
+	assert.Equal(t, "d5:filesld6:lengthi3e4:pathl1:ai7eeee4:name3:dire", string(info.raw()))
+}
+
+func TestDumpJSON(t *testing.T) {
+	o := NewDict(map[string]*BObject{
+		"b":      NewList(NewInt(1), NewString("x")),
+		"a":      NewString("y"),
+		"pieces": NewString("\xff\x00"),
+	})
+	data, err := o.MarshalJSON()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"a":"y","b":[1,"x"],"pieces":"<hex:ff00>"}`, string(data))
+	assert.Equal(t, "[\n  1,\n  \"x\"\n]", NewList(NewInt(1), NewString("x")).String())
+}
@@ -0,0 +1,178 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+func NewString(val string) *BObject {
+	return &BObject{typ_: BSTR, val_: val}
+}
+
+func NewInt(val int) *BObject {
+	return &BObject{typ_: BINT, val_: val}
+}
+
+func NewList(items ...*BObject) *BObject {
+	list := make([]*BObject, 0, len(items))
+	return &BObject{typ_: BLIST, val_: append(list, items...)}
+}
+
+// NewDict returns a dict object holding dict, or an empty one if dict is nil
+func NewDict(dict map[string]*BObject) *BObject {
+	if dict == nil {
+		dict = make(map[string]*BObject)
+	}
+	return &BObject{typ_: BDICT, val_: dict}
+}
+
+func (o *BObject) Type() BType {
+	return o.typ_
+}
+
+// The setters below edit o in place. An edited object forgets the bytes it
+// was parsed from, and so do the objects containing it, see Raw.
+
+func (o *BObject) SetStr(val string) {
+	o.typ_, o.val_, o.raw_ = BSTR, val, nil
+}
+
+func (o *BObject) SetInt(val int) {
+	o.typ_, o.val_, o.raw_ = BINT, val, nil
+}
+
+// Set adds or replaces the value of key in a dict
+func (o *BObject) Set(key string, val *BObject) error {
+	dict, err := o.entries()
+	if err != nil {
+		return err
+	}
+	dict[key] = val
+	o.raw_ = nil
+	return nil
+}
+
+// Delete removes key from a dict
+func (o *BObject) Delete(key string) error {
+	dict, err := o.entries()
+	if err != nil {
+		return err
+	}
+	delete(dict, key)
+	o.raw_ = nil
+	return nil
+}
+
+// Append adds items to the end of a list
+func (o *BObject) Append(items ...*BObject) error {
+	list, err := o.items()
+	if err != nil {
+		return err
+	}
+	o.val_ = append(list, items...)
+	o.raw_ = nil
+	return nil
+}
+
+// SetIndex replaces the i-th item of a list
+func (o *BObject) SetIndex(i int, val *BObject) error {
+	list, err := o.items()
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(list) {
+		return fmt.Errorf("%w: index %d out of range [0, %d)", ErrPth, i, len(list))
+	}
+	list[i] = val
+	o.raw_ = nil
+	return nil
+}
+
+// Get walks down o following path, where a string step looks up a dict key
+// and an int step indexes a list, e.g. o.Get("info", "files", 0, "path").
+func (o *BObject) Get(path ...interface{}) (*BObject, error) {
+	cur := o
+	for _, step := range path {
+		switch s := step.(type) {
+		case string:
+			dict, err := cur.entries()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s at key %q", err, cur.typ_, s)
+			}
+			next, ok := dict[s]
+			if !ok {
+				return nil, fmt.Errorf("%w: no key %q", ErrPth, s)
+			}
+			cur = next
+		case int:
+			list, err := cur.items()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s at index %d", err, cur.typ_, s)
+			}
+			if s < 0 || s >= len(list) {
+				return nil, fmt.Errorf("%w: index %d out of range [0, %d)", ErrPth, s, len(list))
+			}
+			cur = list[s]
+		default:
+			return nil, fmt.Errorf("%w: invalid path step %v", ErrPth, step)
+		}
+	}
+	return cur, nil
+}
+
+// jsonValue converts o into values encoding/json can print. Strings that
+// aren't valid UTF-8, like piece hashes, are shown in hex as "<hex:...>".
+func jsonValue(o *BObject) interface{} {
+	switch o.typ_ {
+	case BSTR:
+		str, _ := o.Str()
+		if !utf8.ValidString(str) {
+			return "<hex:" + hex.EncodeToString([]byte(str)) + ">"
+		}
+		return str
+	case BLIST:
+		list, _ := o.items()
+		res := make([]interface{}, len(list))
+		for i, item := range list {
+			res[i] = jsonValue(item)
+		}
+		return res
+	case BDICT:
+		dict, _ := o.entries()
+		res := make(map[string]interface{}, len(dict))
+		for key, item := range dict {
+			res[key] = jsonValue(item)
+		}
+		return res
+	}
+	return o.val_
+}
+
+// dumpJSON encodes the jsonValue of o, leaving '<' and '>' unescaped
+func dumpJSON(o *BObject, indent string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(jsonValue(o)); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// MarshalJSON dumps o as JSON for debugging, see jsonValue
+func (o *BObject) MarshalJSON() ([]byte, error) {
+	return dumpJSON(o, "")
+}
+
+// String returns an indented JSON dump of o
+func (o *BObject) String() string {
+	data, err := dumpJSON(o, "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
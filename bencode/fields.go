@@ -0,0 +1,165 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field describes a struct field that maps to a key of a bencoded dict
+type field struct {
+	key       string
+	index     []int
+	tagged    bool
+	omitEmpty bool
+	required  bool
+}
+
+// parseTag splits a struct tag into its key and comma-separated options,
+// e.g. `bencode:"length,omitempty"`
+func parseTag(tag string) (string, []string) {
+	parts := strings.Split(tag, ",")
+	return parts[0], parts[1:]
+}
+
+func hasOption(opts []string, opt string) bool {
+	for _, o := range opts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyValue reports whether v is the zero value of a field tagged with omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedTypeFields is like typeFields but caches the result per type
+func cachedTypeFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+// typeFields returns the fields of struct type t which take part in encoding,
+// following the rules of encoding/json: unexported fields and fields tagged
+// with "-" are ignored, and the fields of embedded structs without a tag key
+// are promoted into the outer dict. When several fields share a key, the
+// shallowest one wins; a tie at the same depth is broken by a tag, and a tie
+// that is still ambiguous drops the key.
+func typeFields(t reflect.Type) []field {
+	type entry struct {
+		typ   reflect.Type
+		index []int
+	}
+
+	var fields []field
+	visited := map[reflect.Type]bool{}
+	current := []entry{{typ: t}}
+	for len(current) > 0 {
+		var next []entry
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				tag := sf.Tag.Get(BENCODE)
+				if tag == "-" {
+					continue
+				}
+				name, opts := parseTag(tag)
+				index := make([]int, len(e.index)+1)
+				copy(index, e.index)
+				index[len(e.index)] = i
+
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					// promote the fields of embedded struct
+					next = append(next, entry{ft, index})
+					continue
+				}
+				if !sf.IsExported() {
+					continue
+				}
+				key := name
+				if key == "" {
+					key = strings.ToLower(sf.Name)
+				}
+				fields = append(fields, field{
+					key:       key,
+					index:     index,
+					tagged:    name != "",
+					omitEmpty: hasOption(opts, "omitempty"),
+					required:  hasOption(opts, "required"),
+				})
+			}
+		}
+		current = next
+	}
+
+	sort.SliceStable(fields, func(i, j int) bool {
+		if fields[i].key != fields[j].key {
+			return fields[i].key < fields[j].key
+		}
+		if len(fields[i].index) != len(fields[j].index) {
+			return len(fields[i].index) < len(fields[j].index)
+		}
+		return fields[i].tagged && !fields[j].tagged
+	})
+	res := fields[:0]
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].key == fields[i].key {
+			j++
+		}
+		dominant := fields[i]
+		if j-i == 1 || len(fields[i+1].index) > len(dominant.index) ||
+			(dominant.tagged && !fields[i+1].tagged) {
+			res = append(res, dominant)
+		}
+		i = j
+	}
+	return res
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but it allocates nil
+// embedded pointers if alloc is set, and otherwise reports false on meeting one.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
@@ -0,0 +1,178 @@
+package bencode
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var fuzzSeeds = []string{
+	"",
+	"i0e",
+	"i-42e",
+	"4:spam",
+	"0:",
+	"le",
+	"de",
+	"li1e4:spamd1:ai1eee",
+	"d4:infod4:name6:archer7:privatei1ee3:tagli1ei2eee",
+	"d1:bi2e1:ai1ee",
+	"d1:ai1e1:ai2ee",
+	"l",
+	"d3:key",
+	"10:abc",
+	"i-0e",
+	"i03e",
+	"i9223372036854775808e",
+	"-5:abc",
+	"llllllllllllllllllllee",
+}
+
+// addTorrentSeeds adds the torrent files shipped in testfile/ to the corpus
+func addTorrentSeeds(f *testing.F) {
+	files, _ := filepath.Glob("../testfile/*.torrent")
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			f.Add(data)
+		}
+	}
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+}
+
+// checkRoundTrip parses data and checks that encoding the tree and parsing
+// it again yields the same tree, and that the encoding is canonical.
+func checkRoundTrip(t *testing.T, data []byte) {
+	o, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	n := o.Bencode(buf)
+	if n != buf.Len() {
+		t.Fatalf("Bencode returned %d, wrote %d bytes", n, buf.Len())
+	}
+	o2, err := ParseStrict(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("re-parse of %q failed: %v", buf.Bytes(), err)
+	}
+	if !reflect.DeepEqual(genericValue(o), genericValue(o2)) {
+		t.Fatalf("round trip mismatch:\n%#v\n%#v", genericValue(o), genericValue(o2))
+	}
+	if !bytes.Equal(buf.Bytes(), o2.Raw()) {
+		t.Fatalf("raw mismatch: %q != %q", buf.Bytes(), o2.Raw())
+	}
+	buf2 := new(bytes.Buffer)
+	o2.Bencode(buf2)
+	if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Fatalf("encoding is not stable: %q != %q", buf.Bytes(), buf2.Bytes())
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	addTorrentSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRoundTrip(t, data)
+
+		// a limited parser must never accept more than the limits allow
+		dec := NewDecoder(bytes.NewReader(data))
+		dec.SetOptions(DecodeOptions{MaxStringLen: 64, MaxDepth: 4, MaxSize: 256, StrictInts: true})
+		if o, err := dec.Parse(); err == nil && len(o.Raw()) > 256 {
+			t.Fatalf("limited parse returned %d bytes", len(o.Raw()))
+		}
+	})
+}
+
+type fuzzInfo struct {
+	Files []struct {
+		Length int64    `bencode:"length"`
+		Path   []string `bencode:"path"`
+	} `bencode:"files,omitempty"`
+	Length  int               `bencode:"length,omitempty"`
+	Name    string            `bencode:"name"`
+	Pieces  []byte            `bencode:"pieces"`
+	Private bool              `bencode:"private"`
+	Extra   map[string]string `bencode:"extra"`
+	Raw     RawMessage        `bencode:"raw,omitempty"`
+	Port    uint16            `bencode:"port"`
+	Hash    *digest           `bencode:"hash"`
+	Any     interface{}       `bencode:"any"`
+	Fixed   [2]int8           `bencode:"fixed"`
+}
+
+type fuzzTorrent struct {
+	Announce     string     `bencode:"announce"`
+	AnnounceList [][]string `bencode:"announce-list"`
+	Info         *fuzzInfo  `bencode:"info"`
+	Comment      RawMessage `bencode:"comment,omitempty"`
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	addTorrentSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v interface{}
+		if err := Unmarshal(bytes.NewReader(data), &v); err == nil {
+			// generic values always encode back
+			if err := NewEncoder(new(bytes.Buffer)).Encode(v); err != nil {
+				t.Fatalf("encode of %#v failed: %v", v, err)
+			}
+		}
+		tr := new(fuzzTorrent)
+		if err := Unmarshal(bytes.NewReader(data), tr); err == nil {
+			if err := NewEncoder(new(bytes.Buffer)).Encode(tr); err != nil {
+				t.Fatalf("encode of %#v failed: %v", tr, err)
+			}
+		}
+		var list []int
+		_ = Unmarshal(bytes.NewReader(data), &list)
+	})
+}
+
+func FuzzDecodeString(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		str, err := DecodeString(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		buf := new(bytes.Buffer)
+		if n := EncodeString(buf, str); n != buf.Len() || n > len(data) {
+			t.Fatalf("EncodeString returned %d for %q", n, data)
+		}
+		str2, err := DecodeString(buf)
+		if err != nil || str2 != str {
+			t.Fatalf("round trip of %q failed: %v", data, err)
+		}
+	})
+}
+
+func TestRoundTripTestfiles(t *testing.T) {
+	files, err := filepath.Glob("../testfile/*.torrent")
+	assert.Equal(t, nil, err)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		assert.Equal(t, nil, err)
+		checkRoundTrip(t, data)
+
+		// canonical files must come out byte for byte
+		if _, err := ParseStrict(bytes.NewReader(data)); err == nil {
+			o, _ := Parse(bytes.NewReader(data))
+			buf := new(bytes.Buffer)
+			o.Bencode(buf)
+			assert.Equal(t, data, buf.Bytes(), file)
+		}
+	}
+}
+
+func TestRoundTripValues(t *testing.T) {
+	for _, s := range fuzzSeeds {
+		checkRoundTrip(t, []byte(s))
+	}
+}
@@ -1,232 +1,587 @@
 package bencode
 
 import (
+	"bufio"
+	"bytes"
+	"encoding"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 const BENCODE = "bencode"
 
-func Marshal(w io.Writer, s interface{}) int {
-	v := reflect.ValueOf(s)
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
+// Marshaler is implemented by types that encode themselves into bencode.
+// MarshalBencode must return a single valid bencoded value.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that decode themselves from bencode.
+// UnmarshalBencode receives the raw encoding of a single value and must copy
+// it if it wants to keep the data.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+var (
+	marshalerType     = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// MarshalerError wraps an error returned by a Marshaler or TextMarshaler
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return "bencode: error calling MarshalBencode for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+func (e *MarshalerError) Unwrap() error {
+	return e.Err
+}
+
+// UnmarshalTypeError describes a bencoded value that can't be stored into a
+// Go value of the given type. Path locates the value in the input, e.g.
+// "info.files[2].path[0]"; it is empty for the top-level value.
+type UnmarshalTypeError struct {
+	Value string
+	Type  reflect.Type
+	Path  string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	msg := "bencode: cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
+	if e.Path != "" {
+		msg += " at " + e.Path
+	}
+	return msg
+}
+
+// Unwrap lets errors.Is match ErrTyp
+func (e *UnmarshalTypeError) Unwrap() error {
+	return ErrTyp
+}
+
+// typeError reports that o can't be stored into v
+func typeError(o *BObject, v reflect.Value) error {
+	return &UnmarshalTypeError{Value: o.typ_.String(), Type: v.Type()}
+}
+
+// addPath prefixes the location of a failing value with one more step
+// from the top, a dict key or a "[i]" list index.
+func addPath(err error, step string) error {
+	te, ok := err.(*UnmarshalTypeError)
+	if !ok {
+		return err
+	}
+	if te.Path != "" && !strings.HasPrefix(te.Path, "[") {
+		step += "."
 	}
-	return MarshalValue(w, v)
+	te.Path = step + te.Path
+	return te
 }
 
+var (
+	bobjectType    = reflect.TypeOf(BObject{})
+	rawMessageType = reflect.TypeOf(RawMessage{})
+)
+
+// RawMessage is a raw encoded bencode value. Unmarshal stores the exact
+// bytes of the value into it and Marshal writes them back verbatim, which
+// is useful when the original encoding matters, e.g. for hashing.
+type RawMessage []byte
+
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, errors.New("empty RawMessage")
+	}
+	return m, nil
+}
+
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+var errUnmarshalDest = errors.New("unmarshal destination must be a non-nil pointer")
+
+// Marshal writes the bencoding of s to w and returns the number of bytes
+// written, or 0 on failure. Use Encoder to get hold of the error.
+func Marshal(w io.Writer, s interface{}) int {
+	return MarshalValue(w, reflect.ValueOf(s))
+}
+
+// MarshalValue writes the bencoding of v to w. Booleans are encoded as the
+// integers 0 and 1, []byte as a string, maps with string keys and structs as
+// dicts. Nil pointers and interfaces have no encoding and write nothing.
 func MarshalValue(w io.Writer, v reflect.Value) int {
-	wLen := 0
+	e := newEncoder(w)
+	e.value(v)
+	e.flush()
+	if e.err != nil {
+		return 0
+	}
+	return e.n
+}
+
+// encoder writes bencoded values through a buffer, counting the bytes
+// written and keeping the first error met, after which it writes nothing.
+type encoder struct {
+	w       io.Writer
+	bw      *bufio.Writer
+	scratch []byte
+	n       int
+	err     error
+}
+
+func newEncoder(w io.Writer) *encoder {
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriter(w)
+	}
+	return &encoder{w: w, bw: bw}
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	n, err := e.bw.Write(p)
+	e.n += n
+	e.err = err
+}
+
+func (e *encoder) writeByte(b byte) {
+	e.scratch = append(e.scratch[:0], b)
+	e.write(e.scratch)
+}
+
+func (e *encoder) flush() {
+	if e.err != nil {
+		return
+	}
+	e.err = e.bw.Flush()
+}
+
+func (e *encoder) encodeString(val string) {
+	e.scratch = appendString(e.scratch[:0], val)
+	e.write(e.scratch)
+}
+
+func (e *encoder) encodeInt(val int64) {
+	e.scratch = appendInt(e.scratch[:0], val)
+	e.write(e.scratch)
+}
+
+func (e *encoder) object(o *BObject) {
+	switch o.typ_ {
+	case BSTR:
+		str, _ := o.Str()
+		e.encodeString(str)
+	case BINT:
+		num, _ := o.Int()
+		e.encodeInt(int64(num))
+	case BLIST:
+		e.writeByte('l')
+		list, _ := o.items()
+		for _, obj := range list {
+			e.object(obj)
+		}
+		e.writeByte('e')
+	case BDICT:
+		e.writeByte('d')
+		dict, _ := o.entries()
+		for _, key := range sortedKeys(dict) {
+			e.encodeString(key)
+			e.object(dict[key])
+		}
+		e.writeByte('e')
+	}
+}
+
+func (e *encoder) value(v reflect.Value) {
+	if !v.IsValid() {
+		return
+	}
+	t := v.Type()
+	if t.Kind() != reflect.Ptr && v.CanAddr() &&
+		(reflect.PtrTo(t).Implements(marshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)) {
+		v = v.Addr()
+		t = v.Type()
+	}
+	if t.Implements(marshalerType) {
+		e.marshaler(v)
+		return
+	}
+	if t.Implements(textMarshalerType) {
+		e.textMarshaler(v)
+		return
+	}
+	if t == bobjectType {
+		o := v.Interface().(BObject)
+		e.object(&o)
+		return
+	}
 	switch v.Kind() {
-	case reflect.Int:
-		wLen += EncodeInt(w, int(v.Int()))
+	case reflect.Bool:
+		if v.Bool() {
+			e.encodeInt(1)
+		} else {
+			e.encodeInt(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		// larger values couldn't be decoded back, see readDecimal
+		if v.Uint() > math.MaxInt64 {
+			if e.err == nil {
+				e.err = &UnsupportedValueError{v, strconv.FormatUint(v.Uint(), 10)}
+			}
+			return
+		}
+		e.encodeInt(int64(v.Uint()))
 	case reflect.String:
-		wLen += EncodeString(w, v.String())
+		e.encodeString(v.String())
 	case reflect.Slice:
-		wLen += marshalList(w, v)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeString(string(v.Bytes()))
+		} else {
+			e.marshalList(v)
+		}
+	case reflect.Array:
+		e.marshalList(v)
+	case reflect.Map:
+		e.marshalMap(v)
 	case reflect.Struct:
-		wLen += marshalDict(w, v)
+		e.marshalDict(v)
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			e.value(v.Elem())
+		}
+	default:
+		if e.err == nil {
+			e.err = &UnsupportedTypeError{v.Type()}
+		}
+	}
+}
+
+func (e *encoder) marshaler(v reflect.Value) {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return
+	}
+	data, err := v.Interface().(Marshaler).MarshalBencode()
+	if err == nil {
+		err = checkValid(data)
+	}
+	if err != nil {
+		if e.err == nil {
+			e.err = &MarshalerError{v.Type(), err}
+		}
+		return
+	}
+	e.write(data)
+}
+
+func (e *encoder) textMarshaler(v reflect.Value) {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return
+	}
+	text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		if e.err == nil {
+			e.err = &MarshalerError{v.Type(), err}
+		}
+		return
+	}
+	e.encodeString(string(text))
+}
+
+// checkValid reports whether data is exactly one bencoded value
+func checkValid(data []byte) error {
+	p := newParser(bytes.NewReader(data))
+	_, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	if _, err := p.br.Peek(1); err != io.EOF {
+		return &DecodeError{Offset: p.offset(), Err: errors.New("trailing data")}
 	}
-	return wLen
+	return nil
 }
 
-func marshalDict(w io.Writer, v reflect.Value) int {
-	wLen := 2
-	_, _ = w.Write([]byte{'d'})
-	for i, n := 0, v.NumField(); i < n; i++ {
-		fv := v.Field(i)
-		ft := v.Type().Field(i)
-		key := ft.Tag.Get(BENCODE)
-		if key == "" {
-			key = strings.ToLower(ft.Name)
+// isNil reports whether v has no encoding, so it must be left out of a dict.
+// That's the case of an empty RawMessage too, e.g. one never unmarshaled into.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice:
+		return v.Type() == rawMessageType && v.Len() == 0
+	}
+	return !v.IsValid()
+}
+
+func (e *encoder) marshalDict(v reflect.Value) {
+	e.writeByte('d')
+	// fields are already sorted by key
+	for _, f := range cachedTypeFields(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || isNil(fv) || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
 		}
-		wLen += EncodeString(w, key)
-		wLen += MarshalValue(w, fv)
+		e.encodeString(f.key)
+		e.value(fv)
 	}
-	_, _ = w.Write([]byte{'e'})
-	return wLen
+	e.writeByte('e')
 }
 
-func marshalList(w io.Writer, v reflect.Value) int {
-	wLen := 2
-	_, _ = w.Write([]byte{'l'})
+func (e *encoder) marshalMap(v reflect.Value) {
+	if v.Type().Key().Kind() != reflect.String {
+		if e.err == nil {
+			e.err = &UnsupportedTypeError{v.Type()}
+		}
+		return
+	}
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	// keys must appear in sorted order
+	sort.Strings(keys)
+
+	e.writeByte('d')
+	for _, key := range keys {
+		mv := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if isNil(mv) {
+			continue
+		}
+		e.encodeString(key)
+		e.value(mv)
+	}
+	e.writeByte('e')
+}
+
+func (e *encoder) marshalList(v reflect.Value) {
+	e.writeByte('l')
 	for i := 0; i < v.Len(); i++ {
-		wLen += MarshalValue(w, v.Index(i))
+		e.value(v.Index(i))
+	}
+	e.writeByte('e')
+}
+
+// indirect walks down v, allocating nil pointers, until it reaches a value
+// implementing Unmarshaler or encoding.TextUnmarshaler, or a non-pointer.
+func indirect(v reflect.Value) (Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
+	for {
+		if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().CanInterface() {
+			switch u := v.Addr().Interface().(type) {
+			case Unmarshaler:
+				return u, nil, reflect.Value{}
+			case encoding.TextUnmarshaler:
+				return nil, u, reflect.Value{}
+			}
+		}
+		if v.Kind() != reflect.Ptr {
+			return nil, nil, v
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+}
+
+// raw returns the encoding of o, which for parsed objects is the original input
+func (o *BObject) raw() []byte {
+	if raw := o.Raw(); raw != nil {
+		return raw
 	}
-	_, _ = w.Write([]byte{'e'})
-	return wLen
+	buf := new(bytes.Buffer)
+	o.Bencode(buf)
+	return buf.Bytes()
 }
 
-func unmarshalList(p reflect.Value, list []*BObject) error {
-	if p.Kind() != reflect.Ptr || p.Elem().Type().Kind() != reflect.Slice {
-		return errors.New("must be pointer to slice")
+// unmarshalValue stores o into v, which must be settable. Pointers are
+// allocated as needed and an empty interface receives the generic value of o.
+func unmarshalValue(v reflect.Value, o *BObject) error {
+	u, tu, v := indirect(v)
+	if u != nil {
+		return u.UnmarshalBencode(o.raw())
 	}
-	v := p.Elem()
-	if len(list) == 0 {
+	if tu != nil {
+		val, err := o.Str()
+		if err != nil {
+			return &UnmarshalTypeError{Value: o.typ_.String(), Type: reflect.TypeOf(tu)}
+		}
+		return tu.UnmarshalText([]byte(val))
+	}
+	if v.Type() == bobjectType {
+		v.Set(reflect.ValueOf(*o))
 		return nil
 	}
-	switch list[0].typ_ {
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() != 0 {
+			return typeError(o, v)
+		}
+		v.Set(reflect.ValueOf(genericValue(o)))
+		return nil
+	}
+
+	switch o.typ_ {
 	case BSTR:
-		for i, item := range list {
-			val, err := item.Str()
-			if err != nil {
-				return err
-			}
-			v.Index(i).SetString(val)
+		val, _ := o.Str()
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(val)
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes([]byte(val))
+		default:
+			return typeError(o, v)
 		}
 	case BINT:
-		for i, item := range list {
-			val, err := item.Int()
-			if err != nil {
-				return err
+		val, _ := o.Int()
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.OverflowInt(int64(val)) {
+				return &UnmarshalTypeError{Value: "int " + strconv.Itoa(val), Type: v.Type()}
+			}
+			v.SetInt(int64(val))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if val < 0 || v.OverflowUint(uint64(val)) {
+				return &UnmarshalTypeError{Value: "int " + strconv.Itoa(val), Type: v.Type()}
 			}
-			v.Index(i).SetInt(int64(val))
+			v.SetUint(uint64(val))
+		case reflect.Bool:
+			v.SetBool(val != 0)
+		default:
+			return typeError(o, v)
+		}
+	case BLIST:
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return typeError(o, v)
+		}
+		val, _ := o.items()
+		return unmarshalList(v, val)
+	case BDICT:
+		if v.Kind() != reflect.Map && v.Kind() != reflect.Struct {
+			return typeError(o, v)
 		}
+		val, _ := o.entries()
+		return unmarshalDict(v, val)
+	}
+	return nil
+}
+
+// genericValue converts o into plain Go values: string, int,
+// []interface{} and map[string]interface{}
+func genericValue(o *BObject) interface{} {
+	switch o.typ_ {
 	case BLIST:
+		list, _ := o.items()
+		res := make([]interface{}, len(list))
 		for i, item := range list {
-			val, err := item.List()
-			if err != nil {
-				return err
-			}
-			if v.Type().Elem().Kind() != reflect.Slice {
-				return ErrTyp
-			}
-			lp := reflect.New(v.Type().Elem())
-			ls := reflect.MakeSlice(v.Type().Elem(), len(val), len(val))
-			lp.Elem().Set(ls)
-			err = unmarshalList(lp, val)
-			if err != nil {
-				return err
-			}
-			v.Index(i).Set(lp.Elem())
+			res[i] = genericValue(item)
 		}
+		return res
 	case BDICT:
+		dict, _ := o.entries()
+		res := make(map[string]interface{}, len(dict))
+		for key, item := range dict {
+			res[key] = genericValue(item)
+		}
+		return res
+	}
+	return o.val_
+}
+
+// unmarshalList stores list into a slice or array. Each element is decoded on
+// its own, so mixed lists work with []interface{} or []*BObject elements.
+func unmarshalList(v reflect.Value, list []*BObject) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		sl := reflect.MakeSlice(v.Type(), len(list), len(list))
 		for i, item := range list {
-			val, err := item.Dict()
+			err := unmarshalValue(sl.Index(i), item)
 			if err != nil {
-				return err
+				return addPath(err, "["+strconv.Itoa(i)+"]")
 			}
-			if v.Type().Elem().Kind() != reflect.Struct {
-				return ErrTyp
+		}
+		v.Set(sl)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if i >= len(list) {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+				continue
 			}
-			sp := reflect.New(v.Type().Elem())
-			err = unmarshalDict(sp, val)
+			err := unmarshalValue(v.Index(i), list[i])
 			if err != nil {
-				return err
+				return addPath(err, "["+strconv.Itoa(i)+"]")
 			}
-			v.Index(i).Set(sp.Elem())
 		}
+	default:
+		return &UnmarshalTypeError{Value: BLIST.String(), Type: v.Type()}
 	}
 	return nil
 }
 
-func unmarshalDict(p reflect.Value, dict map[string]*BObject) error {
-	if p.Kind() != reflect.Ptr || p.Elem().Type().Kind() != reflect.Struct {
-		return errors.New("must be pointer to struct")
-	}
-	v := p.Elem()
-	for i, n := 0, v.NumField(); i < n; i++ {
-		fv := v.Field(i)
-		if !fv.CanSet() {
-			continue
-		}
-		ft := v.Type().Field(i)
-		key := ft.Tag.Get(BENCODE)
-		if key == "" {
-			key = strings.ToLower(ft.Name)
+func unmarshalDict(v reflect.Value, dict map[string]*BObject) error {
+	switch v.Kind() {
+	case reflect.Map:
+		kt := v.Type().Key()
+		if kt.Kind() != reflect.String {
+			return &UnmarshalTypeError{Value: BDICT.String(), Type: v.Type()}
 		}
-		po := dict[key]
-		if po == nil {
-			continue
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
 		}
-		switch po.typ_ {
-		case BSTR:
-			if ft.Type.Kind() != reflect.String {
-				return ErrTyp
-			}
-			val, err := po.Str()
-			if err != nil {
-				return err
-			}
-			fv.SetString(val)
-		case BINT:
-			if ft.Type.Kind() != reflect.Int {
-				return ErrTyp
-			}
-			val, err := po.Int()
-			if err != nil {
-				return err
-			}
-			fv.SetInt(int64(val))
-		case BLIST:
-			if ft.Type.Kind() != reflect.Slice {
-				return ErrTyp
-			}
-			val, err := po.List()
+		for key, item := range dict {
+			mv := reflect.New(v.Type().Elem()).Elem()
+			err := unmarshalValue(mv, item)
 			if err != nil {
-				return err
+				return addPath(err, key)
 			}
-			lp := reflect.New(ft.Type)
-			ls := reflect.MakeSlice(ft.Type, len(val), len(val))
-			lp.Elem().Set(ls)
-			err = unmarshalList(lp, val)
-			if err != nil {
-				return err
-			}
-			fv.Set(lp.Elem())
-		case BDICT:
-			if ft.Type.Kind() != reflect.Struct {
-				return ErrTyp
+			v.SetMapIndex(reflect.ValueOf(key).Convert(kt), mv)
+		}
+	case reflect.Struct:
+		for _, f := range cachedTypeFields(v.Type()) {
+			po := dict[f.key]
+			if po == nil {
+				if f.required {
+					return fmt.Errorf("%w %q in %v", ErrReq, f.key, v.Type())
+				}
+				continue
 			}
-			val, err := po.Dict()
-			if err != nil {
-				return err
+			fv, ok := fieldByIndex(v, f.index, true)
+			if !ok {
+				continue
 			}
-			sp := reflect.New(ft.Type)
-			err = unmarshalDict(sp, val)
+			err := unmarshalValue(fv, po)
 			if err != nil {
-				return err
+				return addPath(err, f.key)
 			}
-			fv.Set(sp.Elem())
 		}
+	default:
+		return &UnmarshalTypeError{Value: BDICT.String(), Type: v.Type()}
 	}
 	return nil
 }
 
 func Unmarshal(r io.Reader, s interface{}) error {
+	p := reflect.ValueOf(s)
+	if p.Kind() != reflect.Ptr || p.IsNil() {
+		return errUnmarshalDest
+	}
 	o, err := Parse(r)
 	if err != nil {
 		return err
 	}
-	p := reflect.ValueOf(s)
-	if p.Kind() != reflect.Ptr {
-		return errors.New("unmarshal destination must be a pointer")
-	}
-	switch o.typ_ {
-	case BLIST:
-		val, err := o.List()
-		if err != nil {
-			return err
-		}
-		sl := reflect.MakeSlice(p.Elem().Type(), len(val), len(val))
-		p.Elem().Set(sl)
-		err = unmarshalList(p, val)
-		if err != nil {
-			return err
-		}
-	case BDICT:
-		val, err := o.Dict()
-		if err != nil {
-			return err
-		}
-		err = unmarshalDict(p, val)
-		if err != nil {
-			return err
-		}
-	default:
-		return errors.New("unmarshal source must be slice or dict")
-	}
-	return nil
+	return unmarshalValue(p.Elem(), o)
 }
@@ -2,7 +2,11 @@ package bencode
 
 import (
 	"bytes"
+	"encoding"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"net"
 	"testing"
 )
 
@@ -54,7 +58,7 @@ func TestUnmarshalList(t *testing.T) {
 }
 
 func TestUnmarshalUser(t *testing.T) {
-	str := "d4:name6:archer3:agei29ee"
+	str := "d3:agei29e4:name6:archere"
 	u := &User{}
 	Unmarshal(bytes.NewBufferString(str), u)
 	assert.Equal(t, "archer", u.Name)
@@ -68,7 +72,7 @@ func TestUnmarshalUser(t *testing.T) {
 }
 
 func TestUnmarshalRole(t *testing.T) {
-	str := "d2:idi1e4:userd4:name6:archer3:agei29eee"
+	str := "d2:idi1e4:userd3:agei29e4:name6:archeree"
 	r := &Role{}
 	Unmarshal(bytes.NewBufferString(str), r)
 	assert.Equal(t, 1, r.Id)
@@ -83,7 +87,7 @@ func TestUnmarshalRole(t *testing.T) {
 }
 
 func TestUnmarshalScore(t *testing.T) {
-	str := "d4:userd4:name6:archer3:agei29ee5:valueli80ei85ei90eee"
+	str := "d4:userd3:agei29e4:name6:archere5:valueli80ei85ei90eee"
 	s := &Score{}
 	Unmarshal(bytes.NewBufferString(str), s)
 	assert.Equal(t, "archer", s.Name)
@@ -98,7 +102,7 @@ func TestUnmarshalScore(t *testing.T) {
 }
 
 func TestUnmarshalTeam(t *testing.T) {
-	str := "d4:name3:ace4:sizei2e6:memberld4:name6:archer3:agei29eed4:name5:nancy3:agei31eeee"
+	str := "d6:memberld3:agei29e4:name6:archered3:agei31e4:name5:nancyee4:name3:ace4:sizei2ee"
 	team := &Team{}
 	Unmarshal(bytes.NewBufferString(str), team)
 	assert.Equal(t, "ace", team.Name)
@@ -110,3 +114,291 @@ func TestUnmarshalTeam(t *testing.T) {
 	assert.Equal(t, len(str), length)
 	assert.Equal(t, str, buf.String())
 }
+
+type Wrapper struct {
+	Name string     `bencode:"name"`
+	Info RawMessage `bencode:"info"`
+}
+
+func TestUnmarshalRawMessage(t *testing.T) {
+	str := "d4:infod4:name6:archer3:agei29e5:extrai1ee4:name3:acee"
+	w := &Wrapper{}
+	err := Unmarshal(bytes.NewBufferString(str), w)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ace", w.Name)
+	assert.Equal(t, "d4:name6:archer3:agei29e5:extrai1ee", string(w.Info))
+
+	buf := new(bytes.Buffer)
+	length := Marshal(buf, w)
+	assert.Equal(t, len("d4:infod4:name6:archer3:agei29e5:extrai1ee4:name3:acee"), length)
+	assert.Equal(t, "d4:infod4:name6:archer3:agei29e5:extrai1ee4:name3:acee", buf.String())
+}
+
+func TestMarshalSortedKeys(t *testing.T) {
+	type unordered struct {
+		Zeta  int    `bencode:"zeta"`
+		Alpha string `bencode:"alpha"`
+		Mid   int    `bencode:"mid"`
+	}
+	buf := new(bytes.Buffer)
+	Marshal(buf, unordered{Zeta: 1, Alpha: "a", Mid: 2})
+	assert.Equal(t, "d5:alpha1:a3:midi2e4:zetai1ee", buf.String())
+}
+
+type Base struct {
+	Id   int64  `bencode:"id"`
+	Note string `bencode:"note"`
+}
+
+type Extended struct {
+	Base
+	Note    string            `bencode:"note"`
+	Private bool              `bencode:"private"`
+	Port    uint16            `bencode:"port"`
+	Hash    []byte            `bencode:"hash"`
+	Owner   *User             `bencode:"owner"`
+	Tags    map[string]int    `bencode:"tags"`
+	Extra   interface{}       `bencode:"extra"`
+	Missing *User             `bencode:"missing"`
+	Attrs   map[string]string `bencode:"attrs"`
+}
+
+func TestMarshalReflectKinds(t *testing.T) {
+	str := "d5:attrsde5:extrali1e1:ae4:hash3:\x00\x01\xff2:idi-9000000000e4:note5:outer" +
+		"5:ownerd3:agei29e4:name6:archere4:porti6881e7:privatei1e4:tagsd1:ai1e1:bi2eee"
+	e := &Extended{}
+	err := Unmarshal(bytes.NewBufferString(str), e)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(-9000000000), e.Id)
+	assert.Equal(t, "outer", e.Note)
+	assert.Equal(t, "", e.Base.Note)
+	assert.Equal(t, true, e.Private)
+	assert.Equal(t, uint16(6881), e.Port)
+	assert.Equal(t, []byte{0, 1, 0xff}, e.Hash)
+	assert.Equal(t, &User{Name: "archer", Age: 29}, e.Owner)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, e.Tags)
+	assert.Equal(t, []interface{}{1, "a"}, e.Extra)
+	assert.Nil(t, e.Missing)
+
+	buf := new(bytes.Buffer)
+	length := Marshal(buf, e)
+	assert.Equal(t, len(str), length)
+	assert.Equal(t, str, buf.String())
+}
+
+func TestUnmarshalInterface(t *testing.T) {
+	var v interface{}
+	err := Unmarshal(bytes.NewBufferString("d4:listli1e3:abce3:numi7e3:str1:xe"), &v)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]interface{}{
+		"list": []interface{}{1, "abc"},
+		"num":  7,
+		"str":  "x",
+	}, v)
+}
+
+func TestUnmarshalOverflow(t *testing.T) {
+	var u8 uint8
+	assert.NotEqual(t, nil, Unmarshal(bytes.NewBufferString("i256e"), &u8))
+	var u uint
+	assert.NotEqual(t, nil, Unmarshal(bytes.NewBufferString("i-1e"), &u))
+	var i8 int8
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString("i-128e"), &i8))
+	assert.Equal(t, int8(-128), i8)
+}
+
+func TestMarshalUint64(t *testing.T) {
+	var u uint64 = math.MaxInt64
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(u))
+	assert.Equal(t, "i9223372036854775807e", buf.String())
+	var back uint64
+	assert.Equal(t, nil, Unmarshal(bytes.NewReader(buf.Bytes()), &back))
+	assert.Equal(t, u, back)
+
+	// 1<<63 wouldn't decode, so it isn't encoded either
+	var uve *UnsupportedValueError
+	buf.Reset()
+	err := NewEncoder(buf).Encode(uint64(1 << 63))
+	assert.ErrorAs(t, err, &uve)
+	assert.Equal(t, "", buf.String())
+}
+
+func TestUnmarshalTypeMismatch(t *testing.T) {
+	u := &User{}
+	assert.ErrorIs(t, Unmarshal(bytes.NewBufferString("d4:namei1ee"), u), ErrTyp)
+	var m map[string]int
+	assert.ErrorIs(t, Unmarshal(bytes.NewBufferString("d1:a1:be"), &m), ErrTyp)
+}
+
+type Tagged struct {
+	Name    string `bencode:"name,required"`
+	Length  int    `bencode:"length,omitempty"`
+	Files   []User `bencode:"files,omitempty"`
+	Private bool   `bencode:",omitempty"`
+	Cache   string `bencode:"-"`
+	Dash    int    `bencode:"-,"`
+}
+
+func TestTagOptions(t *testing.T) {
+	buf := new(bytes.Buffer)
+	Marshal(buf, Tagged{Name: "a", Cache: "skip"})
+	assert.Equal(t, "d1:-i0e4:name1:ae", buf.String())
+
+	buf.Reset()
+	Marshal(buf, Tagged{Name: "a", Length: 3, Private: true, Dash: 1})
+	assert.Equal(t, "d1:-i1e6:lengthi3e4:name1:a7:privatei1ee", buf.String())
+
+	tg := &Tagged{}
+	err := Unmarshal(bytes.NewBufferString("d5:cache4:skip4:name1:ae"), tg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", tg.Cache)
+
+	err = Unmarshal(bytes.NewBufferString("d6:lengthi3ee"), tg)
+	assert.ErrorIs(t, err, ErrReq)
+	assert.Contains(t, err.Error(), `"name"`)
+}
+
+type digest [4]byte
+
+func (d digest) MarshalBencode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	EncodeString(buf, string(d[:]))
+	return buf.Bytes(), nil
+}
+
+func (d *digest) UnmarshalBencode(data []byte) error {
+	str, err := DecodeString(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if len(str) != len(d) {
+		return errors.New("bad digest length")
+	}
+	copy(d[:], str)
+	return nil
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalBencode() ([]byte, error) {
+	return []byte("i1"), nil
+}
+
+type Custom struct {
+	Sum    digest    `bencode:"sum"`
+	Parts  []digest  `bencode:"parts"`
+	Ptr    *digest   `bencode:"ptr"`
+	Addr   net.IP    `bencode:"addr"`
+	Stamps []*digest `bencode:"stamps,omitempty"`
+}
+
+func TestMarshaler(t *testing.T) {
+	str := "d4:addr9:127.0.0.15:partsl4:abcd4:efghe3:ptr4:wxyz3:sum4:\x00\x01\x02\x03e"
+	c := &Custom{}
+	err := Unmarshal(bytes.NewBufferString(str), c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, digest{0, 1, 2, 3}, c.Sum)
+	assert.Equal(t, []digest{{'a', 'b', 'c', 'd'}, {'e', 'f', 'g', 'h'}}, c.Parts)
+	assert.Equal(t, &digest{'w', 'x', 'y', 'z'}, c.Ptr)
+	assert.Equal(t, "127.0.0.1", c.Addr.String())
+
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(c))
+	assert.Equal(t, str, buf.String())
+
+	err = Unmarshal(bytes.NewBufferString("d3:sum3:abce"), c)
+	assert.EqualError(t, err, "bad digest length")
+	err = Unmarshal(bytes.NewBufferString("d4:addr3:abce"), c)
+	assert.NotEqual(t, nil, err)
+
+	var me *MarshalerError
+	err = NewEncoder(new(bytes.Buffer)).Encode([]badMarshaler{{}})
+	assert.ErrorAs(t, err, &me)
+	err = NewEncoder(new(bytes.Buffer)).Encode([]RawMessage{{}})
+	assert.ErrorAs(t, err, &me)
+	err = NewEncoder(new(bytes.Buffer)).Encode(RawMessage{})
+	assert.ErrorAs(t, err, &me)
+}
+
+func TestMarshalEmptyRawMessage(t *testing.T) {
+	// an empty RawMessage is left out of dicts, like a nil pointer
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(struct {
+		Name string     `bencode:"name"`
+		Raw  RawMessage `bencode:"raw"`
+	}{Name: "a"}))
+	assert.Equal(t, "d4:name1:ae", buf.String())
+
+	buf.Reset()
+	assert.Equal(t, nil, NewEncoder(buf).Encode(map[string]RawMessage{"a": nil, "b": RawMessage("i1e")}))
+	assert.Equal(t, "d1:bi1ee", buf.String())
+}
+
+func TestMarshalerNilInterface(t *testing.T) {
+	// nil interfaces write nothing, like nil pointers
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode([]Marshaler{nil, digest{'a', 'b', 'c', 'd'}}))
+	assert.Equal(t, "l4:abcde", buf.String())
+
+	buf.Reset()
+	assert.Equal(t, nil, NewEncoder(buf).Encode(struct {
+		Sum  Marshaler              `bencode:"sum"`
+		Text encoding.TextMarshaler `bencode:"text"`
+	}{}))
+	assert.Equal(t, "de", buf.String())
+
+	buf.Reset()
+	assert.Equal(t, nil, NewEncoder(buf).Encode([]encoding.TextMarshaler{nil, net.IPv4(1, 2, 3, 4)}))
+	assert.Equal(t, "l7:1.2.3.4e", buf.String())
+}
+
+func TestUnmarshalMixedList(t *testing.T) {
+	str := "li1e3:abcli2eed1:ai1eee"
+	var any []interface{}
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString(str), &any))
+	assert.Equal(t, []interface{}{1, "abc", []interface{}{2}, map[string]interface{}{"a": 1}}, any)
+
+	var objs []*BObject
+	assert.Equal(t, nil, Unmarshal(bytes.NewBufferString(str), &objs))
+	assert.Equal(t, 4, len(objs))
+	assert.Equal(t, BINT, objs[0].typ_)
+	assert.Equal(t, BSTR, objs[1].typ_)
+	assert.Equal(t, BLIST, objs[2].typ_)
+	assert.Equal(t, BDICT, objs[3].typ_)
+	assert.Equal(t, "d1:ai1ee", string(objs[3].Raw()))
+
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, NewEncoder(buf).Encode(objs))
+	assert.Equal(t, str, buf.String())
+
+	var ints []int
+	err := Unmarshal(bytes.NewBufferString(str), &ints)
+	var te *UnmarshalTypeError
+	if assert.ErrorAs(t, err, &te) {
+		assert.Equal(t, "[1]", te.Path)
+		assert.Equal(t, "string", te.Value)
+	}
+}
+
+func TestUnmarshalTypeErrorPath(t *testing.T) {
+	type file struct {
+		Path []string `bencode:"path"`
+	}
+	type info struct {
+		Files []file `bencode:"files"`
+	}
+	var v struct {
+		Info  info                `bencode:"info"`
+		Extra map[string][]string `bencode:"extra"`
+	}
+	err := Unmarshal(bytes.NewBufferString("d4:infod5:filesld4:pathl1:aeed4:pathl1:bi1eeeeee"), &v)
+	assert.EqualError(t, err, "bencode: cannot unmarshal int into Go value of type string at info.files[1].path[1]")
+
+	err = Unmarshal(bytes.NewBufferString("d5:extrad3:keyli1eeee"), &v)
+	assert.EqualError(t, err, "bencode: cannot unmarshal int into Go value of type string at extra.key[0]")
+
+	var n int
+	err = Unmarshal(bytes.NewBufferString("le"), &n)
+	assert.EqualError(t, err, "bencode: cannot unmarshal list into Go value of type int")
+}
@@ -0,0 +1,131 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// DecodeError describes a failure to decode the input, either malformed
+// bencode or an error of the underlying reader. Offset is the number of bytes
+// consumed from the input when the error was detected.
+type DecodeError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("bencode: %v at offset %d", e.Err, e.Offset)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedTypeError is returned when encoding a value of a type that has
+// no bencode representation, e.g. a channel or a map with non-string keys.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type " + e.Type.String()
+}
+
+// UnsupportedValueError is returned when encoding a value that its type
+// allows but bencode doesn't, e.g. a uint64 beyond the range of int64.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "bencode: unsupported value " + e.Str
+}
+
+// An Encoder writes bencoded values to an output stream, reusing its buffer
+// from one value to the next.
+type Encoder struct {
+	e *encoder
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{e: newEncoder(w)}
+}
+
+// Encode writes the bencoding of v to the stream. It follows the same rules
+// as Marshal, but reports unsupported types and write errors. Nothing of a
+// value that failed to encode is written, unless the stream is itself a
+// *bufio.Writer.
+func (enc *Encoder) Encode(v interface{}) error {
+	e := enc.e
+	e.n, e.err = 0, nil
+	e.value(reflect.ValueOf(v))
+	e.flush()
+	if e.err != nil && e.bw != e.w {
+		// drop what is left of the failed value, and the write error with it
+		e.bw.Reset(e.w)
+	}
+	return e.err
+}
+
+// A Decoder reads consecutive bencoded values from an input stream.
+type Decoder struct {
+	br   *bufio.Reader
+	off  int64
+	opts DecodeOptions
+}
+
+// NewDecoder returns a decoder reading from r. The decoder may read data
+// from r beyond the values requested, unless r is a *bufio.Reader, which is
+// then used directly.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{br: br}
+}
+
+// SetOptions sets the limits applied to the values decoded from now on
+func (d *Decoder) SetOptions(opts DecodeOptions) {
+	d.opts = opts
+}
+
+// Parse reads the next value from the stream as a BObject. At the end of the
+// stream it returns io.EOF, any other error is a *DecodeError.
+func (d *Decoder) Parse() (*BObject, error) {
+	p := &parser{br: d.br, base: d.off, opts: d.opts}
+	o, err := p.parseValue()
+	d.off = p.offset()
+	return o, err
+}
+
+// Decode reads the next value from the stream and stores it in the value
+// pointed to by v, following the rules of Unmarshal.
+func (d *Decoder) Decode(v interface{}) error {
+	p := reflect.ValueOf(v)
+	if p.Kind() != reflect.Ptr || p.IsNil() {
+		return errUnmarshalDest
+	}
+	o, err := d.Parse()
+	if err != nil {
+		return err
+	}
+	return unmarshalValue(p.Elem(), o)
+}
+
+// Buffered returns a reader of the data remaining in the decoder's buffer,
+// i.e. the data that follows the last decoded value.
+func (d *Decoder) Buffered() io.Reader {
+	n := d.br.Buffered()
+	buf, _ := d.br.Peek(n)
+	return bytes.NewReader(buf)
+}
+
+// InputOffset returns the number of bytes consumed from the input so far
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
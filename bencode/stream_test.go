@@ -0,0 +1,159 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+type failWriter struct {
+	n int
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.n < len(p) {
+		n := w.n
+		w.n = 0
+		return n, errors.New("disk full")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestEncoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	assert.Equal(t, nil, enc.Encode(&User{Name: "archer", Age: 29}))
+	assert.Equal(t, nil, enc.Encode([]int{1, 2}))
+	assert.Equal(t, "d3:agei29e4:name6:archereli1ei2ee", buf.String())
+
+	err := NewEncoder(&failWriter{n: 3}).Encode(&User{Name: "archer", Age: 29})
+	assert.EqualError(t, err, "disk full")
+	assert.Equal(t, 0, Marshal(&failWriter{n: 3}, &User{Name: "archer", Age: 29}))
+
+	var ute *UnsupportedTypeError
+	err = NewEncoder(new(bytes.Buffer)).Encode(map[string]chan int{"c": make(chan int)})
+	assert.ErrorAs(t, err, &ute)
+	err = NewEncoder(new(bytes.Buffer)).Encode(map[int]int{1: 1})
+	assert.ErrorAs(t, err, &ute)
+}
+
+func TestEncoderReuse(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	var v interface{} = &User{Name: "archer", Age: 29}
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		enc.Encode(v)
+	})
+	assert.Equal(t, 0.0, allocs)
+
+	// a value failing halfway leaves nothing behind
+	buf.Reset()
+	err := enc.Encode([]interface{}{1, make(chan int)})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, nil, enc.Encode(1))
+	assert.Equal(t, "i1e", buf.String())
+}
+
+func TestDecoderStream(t *testing.T) {
+	in := "d3:agei29e4:name6:archerei7e4:tail" + "raw data"
+	dec := NewDecoder(strings.NewReader(in))
+
+	u := &User{}
+	assert.Equal(t, nil, dec.Decode(u))
+	assert.Equal(t, User{Name: "archer", Age: 29}, *u)
+	assert.Equal(t, int64(25), dec.InputOffset())
+
+	var n int
+	assert.Equal(t, nil, dec.Decode(&n))
+	assert.Equal(t, 7, n)
+
+	var s string
+	assert.Equal(t, nil, dec.Decode(&s))
+	assert.Equal(t, "tail", s)
+
+	rest, _ := io.ReadAll(dec.Buffered())
+	assert.Equal(t, "raw data", string(rest))
+
+	dec = NewDecoder(strings.NewReader("i1ei2e"))
+	assert.Equal(t, nil, dec.Decode(&n))
+	assert.Equal(t, nil, dec.Decode(&n))
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, dec.Decode(&n))
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	cases := []struct {
+		in     string
+		offset int64
+	}{
+		{"l", 1},
+		{"li1e", 4},
+		{"d", 1},
+		{"d3:key", 6},
+		{"d3:keyi1e", 9},
+		{"10:abc", 6},
+		{"i12", 3},
+		{"i", 1},
+		{"5", 1},
+		{"-5:abc", 0},
+	}
+	for _, c := range cases {
+		_, err := NewDecoder(strings.NewReader(c.in)).Parse()
+		var de *DecodeError
+		if assert.ErrorAs(t, err, &de, c.in) {
+			assert.Equal(t, c.offset, de.Offset, c.in)
+		}
+	}
+	_, err := Parse(strings.NewReader("li1e"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = Parse(strings.NewReader("x"))
+	assert.ErrorIs(t, err, ErrIvd)
+}
+
+func TestDecodeOptions(t *testing.T) {
+	parse := func(in string, opts DecodeOptions) error {
+		dec := NewDecoder(strings.NewReader(in))
+		dec.SetOptions(opts)
+		_, err := dec.Parse()
+		return err
+	}
+	assert.Equal(t, nil, parse("5:hello", DecodeOptions{MaxStringLen: 5}))
+	assert.ErrorIs(t, parse("6:hello!", DecodeOptions{MaxStringLen: 5}), ErrLen)
+	assert.ErrorIs(t, parse("99999999999:x", DecodeOptions{MaxStringLen: 1 << 20}), ErrLen)
+
+	assert.Equal(t, nil, parse("llee", DecodeOptions{MaxDepth: 2}))
+	assert.ErrorIs(t, parse("llleee", DecodeOptions{MaxDepth: 2}), ErrDep)
+	assert.ErrorIs(t, parse("ld1:ald1:aleeeee", DecodeOptions{MaxDepth: 4}), ErrDep)
+
+	assert.Equal(t, nil, parse("li1ei2ee", DecodeOptions{MaxSize: 8}))
+	assert.ErrorIs(t, parse("li1ei2ee", DecodeOptions{MaxSize: 7}), ErrBig)
+	assert.ErrorIs(t, parse("9:abcdefghi", DecodeOptions{MaxSize: 8}), ErrBig)
+
+	strict := DecodeOptions{StrictInts: true}
+	assert.Equal(t, nil, parse("i0e", strict))
+	assert.Equal(t, nil, parse("i-10e", strict))
+	assert.Equal(t, nil, parse("0:", strict))
+	assert.ErrorIs(t, parse("i03e", strict), ErrLdz)
+	assert.ErrorIs(t, parse("i-0e", strict), ErrNeg)
+	assert.ErrorIs(t, parse("03:abc", strict), ErrLdz)
+	assert.Equal(t, nil, parse("i03e", DecodeOptions{}))
+
+	assert.ErrorIs(t, parse("i-e", DecodeOptions{}), ErrNum)
+	assert.ErrorIs(t, parse("ie", DecodeOptions{}), ErrNum)
+}
+
+func TestDecodeIntOverflow(t *testing.T) {
+	var n int64
+	assert.Equal(t, nil, Unmarshal(strings.NewReader("i9223372036854775807e"), &n))
+	assert.Equal(t, int64(9223372036854775807), n)
+	assert.Equal(t, nil, Unmarshal(strings.NewReader("i-9223372036854775808e"), &n))
+	assert.Equal(t, int64(-9223372036854775808), n)
+	assert.ErrorIs(t, Unmarshal(strings.NewReader("i9223372036854775808e"), &n), ErrOvf)
+	assert.ErrorIs(t, Unmarshal(strings.NewReader("i-9223372036854775809e"), &n), ErrOvf)
+	assert.ErrorIs(t, Unmarshal(strings.NewReader("99999999999999999999:a"), &n), ErrOvf)
+}
@@ -1,20 +1,34 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/berylyvos/gorrent/torrent"
 	"log"
 )
 
 func main() {
-	inPath := "./testfile/The.Breakfast.Club.1985.REMASTERED.720p.BluRay.999MB.HQ.x265.10bit-GalaxyRG.torrent"
-	outPath := "./nope"
+	inPath := flag.String("torrent", "./testfile/The.Breakfast.Club.1985.REMASTERED.720p.BluRay.999MB.HQ.x265.10bit-GalaxyRG.torrent", "torrent file to download")
+	outPath := flag.String("o", "./nope", "where to save the download")
+	scrape := flag.Bool("scrape", false, "print the swarm each tracker sees, then exit")
+	flag.Parse()
 	// open and parse torrent file
-	tf, err := torrent.Open(inPath)
+	tf, err := torrent.Open(*inPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *scrape {
+		for _, ts := range tf.Scrape() {
+			if ts.Err != nil {
+				fmt.Printf("%v: %v\n", ts.Url, ts.Err)
+				continue
+			}
+			fmt.Printf("%v: %d seeders, %d leechers, %d completed\n", ts.Url, ts.Seeders, ts.Leechers, ts.Completed)
+		}
+		return
+	}
 	// download and save
-	err = tf.DownloadToFile(outPath)
+	err = tf.DownloadToFile(*outPath)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,270 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultAnnounceInterval is how often we announce to a tracker that tells
+// no interval
+const DefaultAnnounceInterval = 30 * time.Minute
+
+// announceStopTimeout bounds how long Stop waits for the trackers
+const announceStopTimeout = 10 * time.Second
+
+// announceRetry is how long we wait before announcing again when every
+// tracker failed, doubled on each failure up to DefaultAnnounceInterval
+const announceRetry = 15 * time.Second
+
+// TrackerStatus is what an Announcer knows of one of its trackers
+type TrackerStatus struct {
+	Url          string
+	Tier         int
+	Working      bool      // the last announce to it succeeded
+	Err          error     // why the last announce failed
+	LastAnnounce time.Time // zero if it was never tried
+	Interval     time.Duration
+	Warning      string // the warning of its last answer
+	Seeders      int
+	Leechers     int
+	Peers        int // peers it told about in its last answer
+}
+
+type trackerEntry struct {
+	tr        tracker
+	started   bool   // it knows about us
+	trackerId string // it asked us to send back
+	status    TrackerStatus
+}
+
+// Announcer keeps a task announced to the trackers of its torrent. It
+// announces `started` first, then every interval the tracker asks for with
+// the counters of the task, `completed` once the task downloaded its last
+// piece, and `stopped` on Stop. The peers the trackers tell about are handed
+// to the task with AddPeers.
+//
+// Trackers are used as BEP-12 says: each tier is shuffled, its trackers are
+// tried in order and the first one to answer moves to the front of its tier.
+// The next tier is tried only when every tracker of a tier failed.
+type Announcer struct {
+	task     *TorrentTask
+	mu       sync.Mutex // guards the order of the tiers and the statuses
+	tiers    [][]*trackerEntry
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{} // closed once run returned, after Stop
+	deadline time.Time     // when Stop gives up waiting for the trackers
+	wg       sync.WaitGroup
+}
+
+// NewAnnouncer returns an announcer of t to the trackers of tf
+func NewAnnouncer(tf *TorrentFile, t *TorrentTask) *Announcer {
+	a := &Announcer{
+		task:    t,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, urls := range tf.announceTiers() {
+		var tier []*trackerEntry
+		for _, u := range urls {
+			tr, err := newTracker(u)
+			if err != nil {
+				fmt.Printf("skip tracker %v: %v\n", u, err)
+				continue
+			}
+			tier = append(tier, &trackerEntry{tr: tr, status: TrackerStatus{Url: u, Tier: len(a.tiers)}})
+		}
+		if len(tier) == 0 {
+			continue
+		}
+		r.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		a.tiers = append(a.tiers, tier)
+	}
+	return a
+}
+
+func (a *Announcer) Start() {
+	a.wg.Add(1)
+	go a.run()
+}
+
+// Stop tells the trackers we leave, and waits for them to answer or time
+// out, announceStopTimeout at most after the first call
+func (a *Announcer) Stop() {
+	a.stopOnce.Do(func() {
+		a.deadline = time.Now().Add(announceStopTimeout)
+		close(a.stop)
+		go func() {
+			a.wg.Wait()
+			close(a.stopped)
+		}()
+	})
+	timer := time.NewTimer(time.Until(a.deadline))
+	defer timer.Stop()
+	select {
+	case <-a.stopped:
+	case <-timer.C:
+		fmt.Println("stop announcing without waiting for the trackers")
+	}
+}
+
+// Status returns the status of each tracker, tier by tier, in the order
+// they're tried
+func (a *Announcer) Status() []TrackerStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var res []TrackerStatus
+	for _, tier := range a.tiers {
+		for _, e := range tier {
+			res = append(res, e.status)
+		}
+	}
+	return res
+}
+
+func (a *Announcer) params(e *trackerEntry, event AnnounceEvent) announceParams {
+	t := a.task
+	return announceParams{
+		infoSHA:    t.InfoSHA,
+		peerId:     t.PeerId,
+		port:       t.Port,
+		uploaded:   t.Uploaded(),
+		downloaded: t.Downloaded(),
+		left:       t.Left(),
+		event:      event,
+		trackerId:  e.trackerId,
+	}
+}
+
+func (a *Announcer) run() {
+	defer a.wg.Done()
+	completed := a.task.completedChan()
+	event := EventStarted
+	retry := announceRetry
+	for {
+		wait := retry
+		res, err := a.announce(event)
+		if err != nil {
+			fmt.Println("announce error: " + err.Error())
+			retry *= 2
+			if retry > DefaultAnnounceInterval {
+				retry = DefaultAnnounceInterval
+			}
+		} else {
+			event = EventNone
+			retry = announceRetry
+			wait = res.Interval
+			if wait <= 0 {
+				wait = DefaultAnnounceInterval
+			}
+			if wait < res.MinInterval {
+				wait = res.MinInterval
+			}
+			a.task.AddPeers(res.Peers)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			event = EventCompleted
+		case <-a.stop:
+			timer.Stop()
+			a.leave()
+			return
+		}
+	}
+}
+
+// announce tries the trackers tier after tier until one answers, or Stop is
+// called. A tracker that doesn't know about us yet is sent `started` instead
+// of event.
+func (a *Announcer) announce(event AnnounceEvent) (*announceResult, error) {
+	var lastErr error
+	// only this goroutine reorders the tiers, reading them needs no lock
+	for _, tier := range a.tiers {
+		for j, e := range tier {
+			select {
+			case <-a.stop:
+				return nil, errors.New("announcer stopped")
+			default:
+			}
+			ev := event
+			if !e.started {
+				ev = EventStarted
+			}
+			res, err := e.tr.announce(a.params(e, ev))
+			a.setStatus(e, res, err)
+			if err != nil {
+				fmt.Printf("announce to %v error: %v\n", e.tr, err)
+				lastErr = err
+				continue
+			}
+			a.mu.Lock()
+			e.started = true
+			// promote the tracker to the front of its tier
+			copy(tier[1:j+1], tier[:j])
+			tier[0] = e
+			a.mu.Unlock()
+			return res, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no tracker")
+	}
+	return nil, fmt.Errorf("every tracker failed, last error: %v", lastErr)
+}
+
+// leave sends `stopped` to the trackers that know about us, all at once
+func (a *Announcer) leave() {
+	var wg sync.WaitGroup
+	for _, tier := range a.tiers {
+		for _, e := range tier {
+			if !e.started {
+				continue
+			}
+			wg.Add(1)
+			go func(e *trackerEntry) {
+				defer wg.Done()
+				res, err := e.tr.announce(a.params(e, EventStopped))
+				a.setStatus(e, res, err)
+				if err != nil {
+					fmt.Printf("announce to %v error: %v\n", e.tr, err)
+				}
+				a.mu.Lock()
+				e.started = false
+				a.mu.Unlock()
+			}(e)
+		}
+	}
+	wg.Wait()
+}
+
+func (a *Announcer) setStatus(e *trackerEntry, res *announceResult, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.status.LastAnnounce = time.Now()
+	e.status.Working = err == nil
+	e.status.Err = err
+	if err == nil {
+		e.status.Interval = res.Interval
+		e.status.Warning = res.Warning
+		e.status.Seeders = res.Seeders
+		e.status.Leechers = res.Leechers
+		e.status.Peers = len(res.Peers)
+		if res.Warning != "" {
+			fmt.Printf("tracker %v warning: %v\n", e.tr, res.Warning)
+		}
+		if res.TrackerId != "" {
+			e.trackerId = res.TrackerId
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// compactPeer returns a peer in the compact format of the trackers, 6 bytes
+// for an IPv4 one and 18 for an IPv6 one
+func compactPeer(ip string, port uint16) string {
+	parsed := net.ParseIP(ip)
+	if ip4 := parsed.To4(); ip4 != nil {
+		parsed = ip4
+	}
+	return string(parsed) + string([]byte{byte(port >> 8), byte(port)})
+}
+
+// httpTrackerServer answers every announce with interval seconds and one
+// peer, and sends the query of each on queries
+func httpTrackerServer(interval int, queries chan url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		peers := compactPeer("10.0.0.1", 6881)
+		w.Write([]byte("d8:intervali" + strconv.Itoa(interval) + "e5:peers6:" + peers + "e"))
+	}))
+}
+
+func nextQuery(t *testing.T, queries chan url.Values) url.Values {
+	select {
+	case q := <-queries:
+		return q
+	case <-time.After(5 * time.Second):
+		t.Fatal("no announce")
+	}
+	return nil
+}
+
+func TestAnnouncer(t *testing.T) {
+	queries := make(chan url.Values, 8)
+	srv := httpTrackerServer(3600, queries)
+	defer srv.Close()
+	tf := newTestTorrent([]byte("some data to announce"), 8, nil)
+	tf.Announce = srv.URL + "/announce"
+	task := tf.newTorrentTask(6881)
+	task.Bitfield = NewBitfield(len(tf.PieceSHA))
+	task.Bitfield.SetPiece(0)
+
+	an := NewAnnouncer(tf, task)
+	an.Start()
+	q := nextQuery(t, queries)
+	assert.Equal(t, "started", q.Get("event"))
+	assert.Equal(t, "6881", q.Get("port"))
+	assert.Equal(t, "13", q.Get("left"))
+	assert.Equal(t, "0", q.Get("uploaded"))
+	assert.Equal(t, string(tf.InfoSHA[:]), q.Get("info_hash"))
+
+	// the last piece is saved
+	atomic.AddInt64(&task.uploaded, 100)
+	atomic.AddInt64(&task.downloaded, 13)
+	task.mu.Lock()
+	task.Bitfield.SetPiece(1)
+	task.Bitfield.SetPiece(2)
+	task.mu.Unlock()
+	close(task.completedChan())
+	q = nextQuery(t, queries)
+	assert.Equal(t, "completed", q.Get("event"))
+	assert.Equal(t, "0", q.Get("left"))
+	assert.Equal(t, "100", q.Get("uploaded"))
+	assert.Equal(t, "13", q.Get("downloaded"))
+
+	an.Stop()
+	q = nextQuery(t, queries)
+	assert.Equal(t, "stopped", q.Get("event"))
+	task.mu.Lock()
+	assert.Equal(t, uint16(6881), task.PeerMap["10.0.0.1:6881"].Port)
+	task.mu.Unlock()
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	queries := make(chan url.Values, 8)
+	srv := httpTrackerServer(1, queries)
+	defer srv.Close()
+	tf := newTestTorrent([]byte("some data"), 8, nil)
+	tf.AnnounceList = []string{srv.URL}
+	task := tf.newTorrentTask(6881)
+
+	an := NewAnnouncer(tf, task)
+	an.Start()
+	defer an.Stop()
+	start := time.Now()
+	assert.Equal(t, "started", nextQuery(t, queries).Get("event"))
+	q := nextQuery(t, queries)
+	assert.Equal(t, "", q.Get("event"))
+	assert.Equal(t, true, time.Since(start) >= time.Second)
+}
+
+// udpAnnounceReq is what serveUDPTracker got told by an announce
+type udpAnnounceReq struct {
+	event AnnounceEvent
+	port  uint16
+}
+
+// serveUDPTracker answers every announce on conn with peers, and sends the
+// event and port of each on announces
+func serveUDPTracker(conn *net.UDPConn, peers string, announces chan udpAnnounceReq) {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		action := binary.BigEndian.Uint32(buf[8:12])
+		trans := buf[12:16]
+		if action == ActionConnect && n == 16 {
+			resp := make([]byte, 16)
+			copy(resp[4:8], trans)
+			binary.BigEndian.PutUint64(resp[8:16], 42)
+			conn.WriteToUDP(resp, addr)
+			continue
+		}
+		if binary.BigEndian.Uint64(buf[0:8]) != 42 || n != 98 {
+			continue
+		}
+		announces <- udpAnnounceReq{
+			event: AnnounceEvent(binary.BigEndian.Uint32(buf[80:84])),
+			port:  binary.BigEndian.Uint16(buf[96:98]),
+		}
+		resp := make([]byte, 20)
+		binary.BigEndian.PutUint32(resp[0:4], ActionAnnounce)
+		copy(resp[4:8], trans)
+		binary.BigEndian.PutUint32(resp[8:12], 3600)
+		resp = append(resp, peers...)
+		conn.WriteToUDP(resp, addr)
+	}
+}
+
+func TestAnnouncerUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	announces := make(chan udpAnnounceReq, 8)
+	go serveUDPTracker(conn, compactPeer("10.0.0.2", 51413), announces)
+
+	tf := newTestTorrent([]byte("some data"), 8, nil)
+	tf.AnnounceList = []string{"udp://127.0.0.1:" + strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port) + "/announce"}
+	task := tf.newTorrentTask(7777)
+	an := NewAnnouncer(tf, task)
+	an.Start()
+	// the port peers reach us on, not the one of the UDP socket
+	assert.Equal(t, udpAnnounceReq{EventStarted, 7777}, <-announces)
+	an.Stop()
+	assert.Equal(t, udpAnnounceReq{EventStopped, 7777}, <-announces)
+	task.mu.Lock()
+	assert.Equal(t, uint16(51413), task.PeerMap["10.0.0.2:51413"].Port)
+	task.mu.Unlock()
+}
+
+// failingTracker answers every announce with an error, counting them
+func failingTracker(hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	var hits1, hits2 int32
+	fail1 := failingTracker(&hits1)
+	defer fail1.Close()
+	fail2 := failingTracker(&hits2)
+	defer fail2.Close()
+	queries := make(chan url.Values, 8)
+	srv := httpTrackerServer(3600, queries)
+	defer srv.Close()
+
+	tf := newTestTorrent([]byte("some data"), 8, nil)
+	tf.Announce = "http://ignored.example/announce"
+	tf.AnnounceTiers = [][]string{{fail1.URL, fail2.URL}, {srv.URL}}
+	an := NewAnnouncer(tf, tf.newTorrentTask(6881))
+	res, err := an.announce(EventNone)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(res.Peers))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits1))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits2))
+	assert.Equal(t, "started", nextQuery(t, queries).Get("event"))
+
+	status := an.Status()
+	assert.Equal(t, 3, len(status))
+	for _, st := range status[:2] {
+		assert.Equal(t, 0, st.Tier)
+		assert.Equal(t, false, st.Working)
+		assert.NotEqual(t, nil, st.Err)
+	}
+	assert.Equal(t, TrackerStatus{Url: srv.URL, Tier: 1, Working: true, LastAnnounce: status[2].LastAnnounce,
+		Interval: time.Hour, Peers: 1}, status[2])
+
+	// the first tier is tried again first
+	_, err = an.announce(EventNone)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits1))
+	assert.Equal(t, "", nextQuery(t, queries).Get("event"))
+
+	// every tier failing is an error
+	srv.Close()
+	_, err = an.announce(EventNone)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestAnnouncePromote(t *testing.T) {
+	var hits int32
+	fail := failingTracker(&hits)
+	defer fail.Close()
+	queries := make(chan url.Values, 8)
+	srv := httpTrackerServer(3600, queries)
+	defer srv.Close()
+
+	tf := newTestTorrent([]byte("some data"), 8, nil)
+	tf.AnnounceTiers = [][]string{{fail.URL, srv.URL}}
+	an := NewAnnouncer(tf, tf.newTorrentTask(6881))
+	_, err := an.announce(EventNone)
+	assert.Equal(t, nil, err)
+	status := an.Status()
+	assert.Equal(t, srv.URL, status[0].Url)
+	assert.Equal(t, fail.URL, status[1].Url)
+
+	// the tracker that answered is tried first from now on
+	before := atomic.LoadInt32(&hits)
+	_, err = an.announce(EventNone)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, before, atomic.LoadInt32(&hits))
+}
+
+func TestAnnouncerStop(t *testing.T) {
+	// trackers answering slowly, with an error
+	var hits int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer slow.Close()
+	tf := newTestTorrent([]byte("some data"), 8, nil)
+	tf.AnnounceTiers = [][]string{{slow.URL + "/1"}, {slow.URL + "/2"}, {slow.URL + "/3"}, {slow.URL + "/4"}}
+	an := NewAnnouncer(tf, tf.newTorrentTask(6881))
+	an.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	// the tiers left aren't tried once stopped
+	start := time.Now()
+	an.Stop()
+	assert.Equal(t, true, time.Since(start) < time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	an.Stop()
+}
@@ -1,5 +1,7 @@
 package torrent
 
+import "math/bits"
+
 // A Bitfield represents the pieces that a peer has
 type Bitfield []byte
 
@@ -22,3 +24,34 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 1 << uint(7-offset)
 }
+
+// NewBitfield returns an empty bitfield able to hold n pieces
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+// Count returns the number of pieces set in the bitfield
+func (bf Bitfield) Count() int {
+	n := 0
+	for _, b := range bf {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// ClearPiece clears a bit in the index of bitfield
+func (bf Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << uint(7-offset)
+}
+
+// resize returns a copy of the bitfield able to hold n pieces
+func (bf Bitfield) resize(n int) Bitfield {
+	res := NewBitfield(n)
+	copy(res, bf)
+	return res
+}
@@ -0,0 +1,190 @@
+package torrent
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChokeConfig tunes the choking algorithm of BEP-3. Zero fields take the
+// value of DefaultChokeConfig.
+type ChokeConfig struct {
+	Slots              int           // peers unchoked for their rate
+	Interval           time.Duration // how often the peers are re-ranked
+	OptimisticInterval time.Duration // how often the optimistic unchoke moves on
+	SnubTimeout        time.Duration // a peer sending us nothing for that long is snubbed
+}
+
+var DefaultChokeConfig = ChokeConfig{
+	Slots:              4,
+	Interval:           10 * time.Second,
+	OptimisticInterval: 30 * time.Second,
+	SnubTimeout:        60 * time.Second,
+}
+
+func (cfg ChokeConfig) withDefaults() ChokeConfig {
+	if cfg.Slots <= 0 {
+		cfg.Slots = DefaultChokeConfig.Slots
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultChokeConfig.Interval
+	}
+	if cfg.OptimisticInterval <= 0 {
+		cfg.OptimisticInterval = DefaultChokeConfig.OptimisticInterval
+	}
+	if cfg.SnubTimeout <= 0 {
+		cfg.SnubTimeout = DefaultChokeConfig.SnubTimeout
+	}
+	return cfg
+}
+
+// clock tells the time to the choker, tests drive it by hand
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// peerRate is what the choker remembers of a peer between two rounds
+type peerRate struct {
+	downloaded   int64 // counters of the peer at the last round
+	uploaded     int64
+	rate         float64 // bytes per second over the last round
+	lastProgress time.Time
+}
+
+// choker decides which peers we upload to. Each round it unchokes the
+// Slots interested peers we download from the fastest, or upload to the
+// fastest once we seed, and one more peer picked at random, the optimistic
+// unchoke, which gives new peers a chance to show their rate. A peer that
+// sent us nothing for SnubTimeout is snubbed: it only keeps an optimistic slot.
+type choker struct {
+	cfg   ChokeConfig
+	clock clock
+	rand  *rand.Rand
+
+	mu             sync.Mutex
+	rates          map[*PeerConn]*peerRate
+	regular        map[*PeerConn]bool
+	optimistic     *PeerConn
+	lastRound      time.Time
+	lastOptimistic time.Time
+}
+
+func newChoker(cfg ChokeConfig, clk clock) *choker {
+	return &choker{
+		cfg:     cfg.withDefaults(),
+		clock:   clk,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		rates:   make(map[*PeerConn]*peerRate),
+		regular: make(map[*PeerConn]bool),
+	}
+}
+
+// run re-chokes every Interval until stop is closed
+func (ch *choker) run(t *TorrentTask, stop chan struct{}) {
+	ticker := time.NewTicker(ch.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ch.rechoke(t.peers(), t.complete())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// interested is called when a peer tells it wants our pieces. Rather than
+// waiting for the next round, it's unchoked at once if a slot is free.
+func (ch *choker) interested(c *PeerConn) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.regular[c] || ch.optimistic == c || len(ch.regular) >= ch.cfg.Slots {
+		return
+	}
+	ch.regular[c] = true
+	c.setChoking(false)
+}
+
+// rechoke runs a round over peers, seeding tells whether to rank them by
+// upload rate, since they have nothing left to give us
+func (ch *choker) rechoke(peers []*PeerConn, seeding bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	now := ch.clock.Now()
+	elapsed := now.Sub(ch.lastRound).Seconds()
+	if ch.lastRound.IsZero() || elapsed <= 0 {
+		elapsed = ch.cfg.Interval.Seconds()
+	}
+	ch.lastRound = now
+
+	// sample the rates, forgetting peers that are gone
+	alive := make(map[*PeerConn]*peerRate, len(peers))
+	for _, c := range peers {
+		r, ok := ch.rates[c]
+		if !ok {
+			r = &peerRate{lastProgress: now}
+		}
+		down := atomic.LoadInt64(&c.downloaded)
+		up := atomic.LoadInt64(&c.uploaded)
+		if seeding {
+			r.rate = float64(up-r.uploaded) / elapsed
+		} else {
+			r.rate = float64(down-r.downloaded) / elapsed
+		}
+		if down > r.downloaded {
+			r.lastProgress = now
+		}
+		r.downloaded, r.uploaded = down, up
+		alive[c] = r
+	}
+	ch.rates = alive
+
+	// rank the interested peers that aren't snubbing us
+	var candidates []*PeerConn
+	for _, c := range peers {
+		snubbed := !seeding && now.Sub(alive[c].lastProgress) >= ch.cfg.SnubTimeout
+		if c.PeerInterested() && !snubbed {
+			candidates = append(candidates, c)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return alive[candidates[i]].rate > alive[candidates[j]].rate
+	})
+	if len(candidates) > ch.cfg.Slots {
+		candidates = candidates[:ch.cfg.Slots]
+	}
+	ch.regular = make(map[*PeerConn]bool, len(candidates))
+	for _, c := range candidates {
+		ch.regular[c] = true
+	}
+
+	// move the optimistic unchoke on when its time is up, or when its peer
+	// left, lost interest or earned a regular slot
+	opt := ch.optimistic
+	if opt == nil || alive[opt] == nil || !opt.PeerInterested() || ch.regular[opt] ||
+		now.Sub(ch.lastOptimistic) >= ch.cfg.OptimisticInterval {
+		var pool []*PeerConn
+		for _, c := range peers {
+			if c.PeerInterested() && !ch.regular[c] {
+				pool = append(pool, c)
+			}
+		}
+		ch.optimistic = nil
+		if len(pool) > 0 {
+			ch.optimistic = pool[ch.rand.Intn(len(pool))]
+		}
+		ch.lastOptimistic = now
+	}
+
+	for _, c := range peers {
+		c.setChoking(!ch.regular[c] && c != ch.optimistic)
+	}
+}
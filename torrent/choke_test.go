@@ -0,0 +1,172 @@
+package torrent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// discardConn swallows what the choker sends
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func newChokePeer(interested bool) *PeerConn {
+	return &PeerConn{Conn: discardConn{}, amChoking: true, peerInterested: interested}
+}
+
+func newTestChoker(slots int) (*choker, *fakeClock) {
+	clk := &fakeClock{now: time.Unix(1000, 0)}
+	ch := newChoker(ChokeConfig{Slots: slots}, clk)
+	ch.rand = rand.New(rand.NewSource(1))
+	return ch, clk
+}
+
+// unchoked returns the indexes of the peers we don't choke
+func unchoked(peers []*PeerConn) []int {
+	var res []int
+	for i, c := range peers {
+		if !c.AmChoking() {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+func TestChokerTopRate(t *testing.T) {
+	ch, clk := newTestChoker(2)
+	peers := []*PeerConn{newChokePeer(true), newChokePeer(true), newChokePeer(true), newChokePeer(false)}
+	atomic.StoreInt64(&peers[0].downloaded, 100)
+	atomic.StoreInt64(&peers[1].downloaded, 300)
+	atomic.StoreInt64(&peers[2].downloaded, 200)
+	atomic.StoreInt64(&peers[3].downloaded, 1000)
+
+	ch.rechoke(peers, false)
+	// 1 and 2 by rate, 0 as the only optimistic candidate, 3 isn't interested
+	assert.Equal(t, []int{0, 1, 2}, unchoked(peers))
+	assert.Equal(t, peers[0], ch.optimistic)
+
+	// 0 overtakes 2, which takes the optimistic slot
+	clk.Advance(10 * time.Second)
+	atomic.AddInt64(&peers[0].downloaded, 500)
+	atomic.AddInt64(&peers[1].downloaded, 600)
+	atomic.AddInt64(&peers[2].downloaded, 10)
+	ch.rechoke(peers, false)
+	assert.Equal(t, true, ch.regular[peers[0]] && ch.regular[peers[1]])
+	assert.Equal(t, peers[2], ch.optimistic)
+	assert.Equal(t, []int{0, 1, 2}, unchoked(peers))
+
+	// when seeding, the upload rate counts
+	clk.Advance(10 * time.Second)
+	atomic.AddInt64(&peers[2].uploaded, 100)
+	atomic.AddInt64(&peers[3].uploaded, 100)
+	ch.rechoke(peers, true)
+	assert.Equal(t, true, ch.regular[peers[2]])
+	assert.Equal(t, false, ch.regular[peers[3]])
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	ch, clk := newTestChoker(1)
+	peers := []*PeerConn{newChokePeer(true), newChokePeer(true), newChokePeer(true), newChokePeer(true)}
+	atomic.StoreInt64(&peers[0].downloaded, 1000)
+	ch.rechoke(peers, false)
+	first := ch.optimistic
+	assert.NotEqual(t, (*PeerConn)(nil), first)
+	assert.NotEqual(t, peers[0], first)
+	assert.Equal(t, 2, len(unchoked(peers)))
+
+	// kept for 30 seconds
+	for i := 0; i < 2; i++ {
+		clk.Advance(10 * time.Second)
+		atomic.AddInt64(&peers[0].downloaded, 1000)
+		ch.rechoke(peers, false)
+		assert.Equal(t, first, ch.optimistic)
+	}
+	// then every peer gets its turn sooner or later
+	seen := map[*PeerConn]bool{}
+	for i := 0; i < 20; i++ {
+		clk.Advance(30 * time.Second)
+		atomic.AddInt64(&peers[0].downloaded, 1000)
+		ch.rechoke(peers, false)
+		seen[ch.optimistic] = true
+		assert.Equal(t, 2, len(unchoked(peers)))
+	}
+	assert.Equal(t, 3, len(seen))
+	assert.Equal(t, false, seen[peers[0]])
+
+	// an optimistic peer losing interest is replaced right away
+	opt := ch.optimistic
+	opt.smu.Lock()
+	opt.peerInterested = false
+	opt.smu.Unlock()
+	clk.Advance(time.Second)
+	ch.rechoke(peers, false)
+	assert.NotEqual(t, opt, ch.optimistic)
+	assert.Equal(t, true, opt.AmChoking())
+}
+
+func TestChokerAntiSnubbing(t *testing.T) {
+	ch, clk := newTestChoker(2)
+	peers := []*PeerConn{newChokePeer(true), newChokePeer(true), newChokePeer(true)}
+	ch.rechoke(peers, false)
+	for i := 0; i < 6; i++ {
+		clk.Advance(10 * time.Second)
+		atomic.AddInt64(&peers[0].downloaded, 100)
+		atomic.AddInt64(&peers[1].downloaded, 100)
+		if i < 3 {
+			// 2 is the fastest until it stops sending
+			atomic.AddInt64(&peers[2].downloaded, 1000)
+		}
+		ch.rechoke(peers, false)
+	}
+	// 2 sent nothing for the last 30s, it lost its slot to faster peers
+	assert.Equal(t, false, ch.regular[peers[2]])
+
+	// after 60s it's snubbed, and doesn't get a regular slot even if free
+	peers = peers[1:]
+	clk.Advance(30 * time.Second)
+	atomic.AddInt64(&peers[0].downloaded, 100)
+	ch.rechoke(peers, false)
+	assert.Equal(t, true, ch.regular[peers[0]])
+	assert.Equal(t, false, ch.regular[peers[1]])
+	assert.Equal(t, peers[1], ch.optimistic)
+	assert.Equal(t, 2, len(ch.rates))
+
+	// snubbing doesn't apply while seeding
+	clk.Advance(10 * time.Second)
+	ch.rechoke(peers, true)
+	assert.Equal(t, true, ch.regular[peers[1]])
+}
+
+func TestChokerInterested(t *testing.T) {
+	ch, _ := newTestChoker(1)
+	a, b := newChokePeer(true), newChokePeer(true)
+	ch.interested(a)
+	assert.Equal(t, false, a.AmChoking())
+	// no free slot left, b waits for the next round
+	ch.interested(b)
+	assert.Equal(t, true, b.AmChoking())
+}
@@ -3,8 +3,10 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,23 +16,47 @@ type TorrentTask struct {
 	InfoSHA  [ShaLen]byte
 	FileName string
 	FileLen  int
+	FileList []File
 	PieceLen int
 	PieceSHA [][ShaLen]byte
-}
+	Storage  Storage // where verified pieces are saved
+	// pieces already in Storage, which are not downloaded again
+	Bitfield Bitfield
+	// where to keep the resume record, no record is kept if empty
+	ResumePath string
+
+	// port we accept peers on, announced to the trackers
+	Port int
+	// tunes which peers we upload to, see ChokeConfig
+	Choke ChokeConfig
+	// Download gives up once no piece arrived for that long,
+	// DefaultStallTimeout if zero
+	StallTimeout time.Duration
 
-type pieceTask struct {
-	index  int
-	sha1   [ShaLen]byte
-	length int
+	mu          sync.Mutex // guards Bitfield, conns, picker and resultQueue
+	conns       map[*PeerConn]struct{}
+	picker      *piecePicker
+	resultQueue chan *pieceResult
+	stop        chan struct{}
+	choker      *choker
+	started     bool
+	wg          sync.WaitGroup
+	uploaded    int64
+	downloaded  int64
+	wasted      int64
+	// closed once Download saved the last missing piece
+	completed chan struct{}
 }
 
+// taskState is what we download from a peer
 type taskState struct {
-	index      int
-	conn       *PeerConn
-	requested  int
-	downloaded int
-	backlog    int
-	data       []byte
+	t    *TorrentTask
+	pp   *piecePicker
+	conn *PeerConn
+	// blocks requested from the peer and not received yet
+	outstanding []blockRequest
+	// when the peer last sent a block, or got requests while it owed none
+	lastBlock time.Time
 }
 
 type pieceResult struct {
@@ -41,119 +67,325 @@ type pieceResult struct {
 const MaxBlockSize = 16384 // 16KB
 const MaxBacklog = 5
 
-func (state *taskState) handleMsg() error {
-	msg, err := state.conn.ReadMsg()
-	if err != nil {
+// blockTimeout drops a peer that sent none of the blocks it owes for that long
+const blockTimeout = 15 * time.Second
+
+// resumeInterval is how often the resume record is saved while downloading
+const resumeInterval = 5 * time.Second
+
+// DefaultStallTimeout is how long Download waits for a piece, e.g. while no
+// tracker answers or no peer connects, before failing
+const DefaultStallTimeout = 3 * time.Minute
+
+func (state *taskState) handleMsg(msg *PeerMsg, resultQueue chan *pieceResult) error {
+	switch msg.Id {
+	case MsgPiece:
+		if len(msg.Payload) < 8 {
+			return fmt.Errorf("payload too short. %d < 8", len(msg.Payload))
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		offset := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		data := msg.Payload[8:]
+		var requested []blockRequest
+		for i, req := range state.outstanding {
+			if req.index == index && req.offset == offset {
+				state.outstanding = append(state.outstanding[:i], state.outstanding[i+1:]...)
+				state.lastBlock = time.Now()
+				requested = append(requested, req)
+				break
+			}
+		}
+		piece, ok := state.pp.received(index, offset, data)
+		if !ok {
+			// another peer sent it first, it crossed our MsgCancel, or it
+			// isn't the block we asked for, e.g. of the wrong length: it's
+			// to be requested again then
+			state.pp.release(requested)
+			atomic.AddInt64(&state.t.wasted, int64(len(data)))
+			return nil
+		}
+		atomic.AddInt64(&state.conn.downloaded, int64(len(data)))
+		atomic.AddInt64(&state.t.downloaded, int64(len(data)))
+		if piece == nil {
+			return nil
+		}
+		res := &pieceResult{index, piece}
+		if !checkPieceIntegrity(state.t.PieceSHA[index], res) {
+			// the blocks are downloaded again, maybe from other peers
+			state.pp.fail(index)
+			return nil
+		}
+		// successfully downloaded and checked, send to result channel
+		select {
+		case resultQueue <- res:
+		case <-state.t.stop:
+			return fmt.Errorf("task stopped")
+		}
+	case MsgChoke:
+		// a peer choking us drops our requests
+		state.conn.Choked = true
+		state.pp.release(state.outstanding)
+		state.outstanding = nil
+	default:
+		_, err := state.t.handlePeerMsg(state.conn, state.pp, msg)
 		return err
 	}
-	// handle keep-alive
-	if msg == nil {
-		return nil
-	}
+	return nil
+}
 
+// handlePeerMsg handles the messages about the state of the peer, or what it
+// wants from us. It returns true when the peer announced a new piece.
+func (t *TorrentTask) handlePeerMsg(c *PeerConn, pp *piecePicker, msg *PeerMsg) (bool, error) {
 	switch msg.Id {
 	case MsgChoke:
-		state.conn.Choked = true
+		c.Choked = true
 	case MsgUnchoke:
-		state.conn.Choked = false
+		c.Choked = false
 	case MsgHave:
 		index, err := GetHaveIndex(msg)
 		if err != nil {
-			return err
+			return false, err
+		}
+		if index >= len(t.PieceSHA) || c.BitField.HasPiece(index) {
+			return false, nil
 		}
-		state.conn.BitField.SetPiece(index)
+		c.BitField.SetPiece(index)
+		if pp != nil {
+			pp.have(index)
+		}
+		return true, nil
 	case MsgPiece:
-		n, err := CopyPieceData(state.index, state.data, msg)
-		if err != nil {
-			return err
+		// only blocks of pieces we no longer download get here
+		if len(msg.Payload) > 8 {
+			atomic.AddInt64(&t.wasted, int64(len(msg.Payload)-8))
 		}
-		state.downloaded += n
-		state.backlog--
+	default:
+		return false, t.handleUpload(c, msg)
 	}
+	return false, nil
+}
 
-	return nil
+// Wasted returns the number of bytes downloaded twice in endgame mode
+func (t *TorrentTask) Wasted() int64 {
+	return atomic.LoadInt64(&t.wasted)
 }
 
-func downloadPiece(conn *PeerConn, task *pieceTask) (*pieceResult, error) {
-	state := &taskState{
-		index: task.index,
-		conn:  conn,
-		data:  make([]byte, task.length),
+// Downloaded returns the number of bytes of the blocks received so far,
+// leaving out the wasted ones
+func (t *TorrentTask) Downloaded() int64 {
+	return atomic.LoadInt64(&t.downloaded)
+}
+
+// Left returns the number of bytes still missing
+func (t *TorrentTask) Left() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	left := int64(t.FileLen)
+	for i := range t.PieceSHA {
+		if t.Bitfield.HasPiece(i) {
+			begin, end := t.getPieceBounds(i)
+			left -= int64(end - begin)
+		}
+	}
+	return left
+}
+
+// AddPeers connects to the peers we don't know yet, e.g. the ones a tracker
+// just told about. Before Download, they're only added to t.PeerMap.
+func (t *TorrentTask) AddPeers(peers []*PeerInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.initLocked()
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+	if t.PeerMap == nil {
+		t.PeerMap = make(map[string]*PeerInfo)
 	}
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+	for _, p := range peers {
+		if _, ok := t.PeerMap[p.Addr()]; ok {
+			continue
+		}
+		t.PeerMap[p.Addr()] = p
+		if t.picker != nil {
+			t.wg.Add(1)
+			go t.peerRoutine(p, t.picker, t.resultQueue)
+		}
+	}
+}
+
+// completedChan returns the channel closed once Download saved the last
+// missing piece. It's never closed if no piece was missing.
+func (t *TorrentTask) completedChan() chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.initLocked()
+	return t.completed
+}
 
-	for state.downloaded < task.length {
+// download requests the blocks the picker hands out from the peer, until
+// every piece is done. The pieces the peer completes are sent to resultQueue.
+func (state *taskState) download(resultQueue chan *pieceResult) error {
+	t, pp, conn := state.t, state.pp, state.conn
+	defer func() {
+		// the blocks done meanwhile are cancelled, the others given back
+		state.cancelStale()
+		pp.release(state.outstanding)
+		state.outstanding = nil
+		conn.SetDeadline(time.Time{})
+	}()
+
+	for !pp.complete() {
+		wake := pp.waitChan()
+		state.cancelStale()
 		// If remote peer unchoked us, send requests until we have enough unfulfilled requests
 		if !conn.Choked {
-			for state.backlog < MaxBacklog && state.requested < task.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if task.length-state.requested < blockSize {
-					blockSize = task.length - state.requested
-				}
-				msg := NewRequestMsg(state.index, state.requested, blockSize)
-				_, err := state.conn.WriteMsg(msg)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+			if err := state.request(); err != nil {
+				return err
+			}
+		}
+		// serve the peer in between, if it asked us for blocks
+		if len(conn.requests) > 0 && !conn.waiting() {
+			if err := t.serveRequest(conn); err != nil {
+				return err
 			}
+			continue
+		}
+		if len(state.outstanding) > 0 {
+			conn.SetReadDeadline(state.lastBlock.Add(blockTimeout))
+		} else {
+			conn.SetReadDeadline(time.Now().Add(seedTimeout))
+		}
+		msg, err := conn.recvMsgUntil(wake)
+		if err == errInterrupted {
+			continue
 		}
-		err := state.handleMsg()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		// handle keep-alive
+		if msg == nil {
+			continue
+		}
+		if err := state.handleMsg(msg, resultQueue); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return &pieceResult{state.index, state.data}, nil
+// request fills the backlog of requests to the peer
+func (state *taskState) request() error {
+	n := MaxBacklog - len(state.outstanding)
+	if n <= 0 {
+		return nil
+	}
+	reqs := state.pp.pickBlocks(state.conn.BitField, n, state.outstanding)
+	if len(reqs) > 0 && len(state.outstanding) == 0 {
+		state.lastBlock = time.Now()
+	}
+	for _, req := range reqs {
+		state.outstanding = append(state.outstanding, req)
+		_, err := state.conn.WriteMsg(NewRequestMsg(req.index, req.offset, req.length))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func checkPieceIntegrity(task *pieceTask, res *pieceResult) bool {
-	sha := sha1.Sum(res.data)
-	if !bytes.Equal(task.sha1[:], sha[:]) {
+// cancelStale cancels the requests of blocks another peer sent first
+func (state *taskState) cancelStale() {
+	kept := state.outstanding[:0]
+	for _, req := range state.outstanding {
+		if state.pp.stale(req) {
+			state.conn.WriteMsg(NewCancelMsg(req.index, req.offset, req.length))
+			continue
+		}
+		kept = append(kept, req)
+	}
+	state.outstanding = kept
+}
+
+func checkPieceIntegrity(sha [ShaLen]byte, res *pieceResult) bool {
+	got := sha1.Sum(res.data)
+	if !bytes.Equal(sha[:], got[:]) {
 		fmt.Printf("check integrity failed, index: %v\n", res.index)
 		return false
 	}
 	return true
 }
 
-func (t *TorrentTask) peerRoutine(peer *PeerInfo, taskQueue chan *pieceTask, resultQueue chan *pieceResult) {
+func (t *TorrentTask) peerRoutine(peer *PeerInfo, pp *piecePicker, resultQueue chan *pieceResult) {
+	defer t.wg.Done()
 	// set up conn with peer
 	peerConn, err := NewConn(peer, t.InfoSHA, t.PeerId)
 	if err != nil {
-		fmt.Printf("failed to connect peer: %s:%d\n", peer.Ip.String(), peer.Port)
+		fmt.Printf("failed to connect peer: %s\n", peer.Addr())
+		return
+	}
+	if !t.addConn(peerConn) {
+		peerConn.Close()
 		return
 	}
-	defer peerConn.Close()
+	defer t.removeConn(peerConn)
 
-	fmt.Printf("complete handshake with peer: %s:%d\n", peer.Ip.String(), peer.Port)
-	peerConn.WriteMsg(&PeerMsg{MsgInterested, nil})
+	fmt.Printf("complete handshake with peer: %s\n", peer.Addr())
+	if err := t.sendBitfield(peerConn); err != nil {
+		return
+	}
+	if err := readBitfield(peerConn, len(t.PieceSHA)); err != nil {
+		return
+	}
+	t.exchange(peerConn, pp, resultQueue)
+}
 
-	// retrieve piece tasks from task channel and try to download
-	for task := range taskQueue {
-		if !peerConn.BitField.HasPiece(task.index) {
-			// if peer don't have current piece, put task back on task channel and continue
-			taskQueue <- task
-			continue
+// acceptPeer takes over a peer that connected to us and completed the handshake
+func (t *TorrentTask) acceptPeer(c *PeerConn) {
+	t.mu.Lock()
+	t.startLocked()
+	pp, resultQueue := t.picker, t.resultQueue
+	t.mu.Unlock()
+	if !t.joinConn(c) {
+		c.Close()
+		return
+	}
+	defer t.wg.Done()
+	defer t.removeConn(c)
+
+	fmt.Printf("accept peer: %s\n", c.peer.Addr())
+	if err := t.sendBitfield(c); err != nil {
+		return
+	}
+	if err := readBitfield(c, len(t.PieceSHA)); err != nil {
+		return
+	}
+	t.exchange(c, pp, resultQueue)
+}
+
+// exchange downloads the blocks pp hands out from a connected peer while any
+// are left, then keeps uploading to it. A nil pp means we aren't downloading.
+func (t *TorrentTask) exchange(peerConn *PeerConn, pp *piecePicker, resultQueue chan *pieceResult) {
+	peerConn.startReader()
+	peerConn.BitField = peerConn.BitField.resize(len(t.PieceSHA))
+	if pp != nil {
+		pp.addPeer(peerConn.BitField)
+		defer pp.removePeer(peerConn.BitField)
+		if !pp.complete() {
+			peerConn.WriteMsg(&PeerMsg{MsgInterested, nil})
 		}
-		res, err := downloadPiece(peerConn, task)
-		if err != nil {
-			// if (network) error occurs while downloading piece, put task back and return
+		state := &taskState{t: t, pp: pp, conn: peerConn}
+		if err := state.download(resultQueue); err != nil {
+			// if (network) error occurs while downloading, the blocks requested are given back
 			// need to close the connection and kill this goroutine
-			taskQueue <- task
-			fmt.Println("failed to down piece: " + err.Error())
+			fmt.Println("failed to download from peer: " + err.Error())
 			return
 		}
-		if !checkPieceIntegrity(task, res) {
-			// if piece integrity check fails, put cur task back on task channel and continue to handle next task
-			taskQueue <- task
-			continue
-		}
-		// successfully downloaded and checked, send to result channel
-		resultQueue <- res
 	}
+	// nothing left to download, keep uploading to the peer
+	t.seedRoutine(peerConn, pp)
 }
 
 func (t *TorrentTask) getPieceBounds(index int) (begin, end int) {
@@ -165,39 +397,100 @@ func (t *TorrentTask) getPieceBounds(index int) (begin, end int) {
 	return
 }
 
-func (t *TorrentTask) Download() ([]byte, error) {
-	fmt.Println("start downloading " + t.FileName)
-	// split pieceTasks and init task & result channel
-	pieceCount := len(t.PieceSHA)
-	taskQueue := make(chan *pieceTask, pieceCount)
-	resultQueue := make(chan *pieceResult)
-	for idx, sha := range t.PieceSHA {
-		begin, end := t.getPieceBounds(idx)
-		taskQueue <- &pieceTask{
-			index:  idx,
-			sha1:   sha,
-			length: end - begin,
-		}
+// Download fetches every piece missing from t.Bitfield and saves each one
+// into t.Storage as soon as it is verified. Connected peers are served our
+// pieces meanwhile, and keep being served after Download returns until Stop.
+func (t *TorrentTask) Download() error {
+	if t.Storage == nil {
+		return fmt.Errorf("no storage for " + t.FileName)
 	}
-	// init goroutines for each peer
+	t.mu.Lock()
+	if t.Bitfield == nil {
+		t.Bitfield = NewBitfield(len(t.PieceSHA))
+	}
+	t.startLocked()
+	// init the piece picker & result channel
+	pieceCount := len(t.PieceSHA) - t.Bitfield.Count()
+	pp := newPiecePicker(t.PieceLen, t.FileLen, t.Bitfield)
+	resultQueue := make(chan *pieceResult)
+	t.picker, t.resultQueue = pp, resultQueue
+	// init goroutines for each peer, the ones added later are started by AddPeers
 	for _, peer := range t.PeerMap {
-		go t.peerRoutine(peer, taskQueue, resultQueue)
+		t.wg.Add(1)
+		go t.peerRoutine(peer, pp, resultQueue)
+	}
+	t.mu.Unlock()
+	fmt.Println("start downloading " + t.FileName)
+	if pieceCount == 0 {
+		fmt.Println("all pieces already downloaded")
 	}
 	// collect piece result
-	buf := make([]byte, t.FileLen)
 	count := 0
+	endgame := false
+	lastSave := time.Now()
+	stallTimeout := t.StallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = DefaultStallTimeout
+	}
+	stall := time.NewTimer(stallTimeout)
+	defer stall.Stop()
 	for count < pieceCount {
-		res := <-resultQueue
-		begin, end := t.getPieceBounds(res.index)
-		copy(buf[begin:end], res.data)
+		var res *pieceResult
+		select {
+		case res = <-resultQueue:
+		case <-stall.C:
+			t.writeResume()
+			return fmt.Errorf("no piece downloaded for %v, from %d peers", stallTimeout, len(t.peers()))
+		case <-t.stop:
+			t.writeResume()
+			return fmt.Errorf("task stopped")
+		}
+		if !stall.Stop() {
+			select {
+			case <-stall.C:
+			default:
+			}
+		}
+		stall.Reset(stallTimeout)
+		err := t.Storage.WritePiece(res.index, res.data)
+		if err != nil {
+			return fmt.Errorf("fail to save piece #%d: %v", res.index, err.Error())
+		}
+		t.setPiece(res.index)
+		// peers move on to seeding once the last piece is done
+		pp.finish(res.index)
 		count++
+		if time.Since(lastSave) >= resumeInterval {
+			t.writeResume()
+			lastSave = time.Now()
+		}
 		// print progress
-		percent := float64(count) / float64(pieceCount) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		fmt.Printf("downloaded piece #%d from %d peers in progress: (%0.2f%%)\n", res.index, numWorkers, percent)
+		percent := float64(t.Bitfield.Count()) / float64(len(t.PieceSHA)) * 100
+		fmt.Printf("downloaded piece #%d from %d peers in progress: (%0.2f%%)\n", res.index, len(t.peers()), percent)
+		if !endgame && pp.endgame() {
+			endgame = true
+			fmt.Println("enter endgame mode, the last pieces are requested from every peer having them")
+		}
+	}
+	if endgame {
+		fmt.Printf("endgame mode wasted %d bytes of duplicate data\n", t.Wasted())
+	}
+	t.writeResume()
+	if pieceCount > 0 {
+		close(t.completedChan())
 	}
-	close(taskQueue)
-	close(resultQueue)
 
-	return buf, nil
+	return nil
+}
+
+// writeResume saves the resume record if t keeps one, failing to do so only
+// costs a re-download after a restart
+func (t *TorrentTask) writeResume() {
+	if t.ResumePath == "" {
+		return
+	}
+	err := t.saveResume()
+	if err != nil {
+		fmt.Println("failed to save resume file: " + err.Error())
+	}
 }
@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener accepts incoming peer connections on a single port and hands each
+// one to the task of the torrent it asks for, so that several torrents can
+// share the port.
+type Listener struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	tasks map[[ShaLen]byte]*TorrentTask
+}
+
+// Listen starts accepting peers on addr. With no host, e.g. ":7777", peers
+// are accepted over both IPv4 and IPv6.
+func Listen(addr string) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		ln:    ln,
+		tasks: make(map[[ShaLen]byte]*TorrentTask),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// Port returns the port peers can reach us on, which is the one to announce
+func (l *Listener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Add routes the peers asking for t.InfoSHA to t
+func (l *Listener) Add(t *TorrentTask) {
+	l.mu.Lock()
+	l.tasks[t.InfoSHA] = t
+	l.mu.Unlock()
+}
+
+func (l *Listener) Remove(t *TorrentTask) {
+	l.mu.Lock()
+	if l.tasks[t.InfoSHA] == t {
+		delete(l.tasks, t.InfoSHA)
+	}
+	l.mu.Unlock()
+}
+
+// Close stops accepting peers, the ones already connected are left to their tasks
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+// handle reads the handshake of an incoming peer first, to learn which
+// torrent it wants, and answers it on behalf of that torrent's task
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	req, err := ReadHandshake(conn)
+	if err != nil || req.PreStr != PreString {
+		conn.Close()
+		return
+	}
+	l.mu.Lock()
+	t, ok := l.tasks[req.InfoSHA]
+	l.mu.Unlock()
+	if !ok {
+		fmt.Printf("reject peer %v for unknown torrent %x\n", conn.RemoteAddr(), req.InfoSHA)
+		conn.Close()
+		return
+	}
+	if req.PeerID == t.PeerId {
+		// we dialed ourselves, see handshake
+		conn.Close()
+		return
+	}
+	_, err = NewHandShakeMsg(t.InfoSHA, t.PeerId).WriteHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		// IPv4 peers reach a dual-stack socket as IPv4-mapped IPv6 addresses
+		ip = ip4
+	}
+	c := &PeerConn{
+		Conn:      conn,
+		Choked:    true,
+		amChoking: true,
+		peer:      &PeerInfo{Ip: ip, Port: uint16(addr.Port)},
+		peerID:    req.PeerID,
+		infoSHA:   t.InfoSHA,
+		reader:    bufio.NewReader(conn),
+	}
+	t.acceptPeer(c)
+}
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// newSeedTask returns a task holding all of data, in pieces of pieceLen
+func newSeedTask(data []byte, pieceLen int) *TorrentTask {
+	tf := newTestTorrent(data, pieceLen, nil)
+	storage := NewMemStorage(tf)
+	task := tf.newTorrentTask(0)
+	task.Storage = storage
+	task.Bitfield = NewBitfield(len(tf.PieceSHA))
+	for i := range tf.PieceSHA {
+		begin, end := task.getPieceBounds(i)
+		_ = storage.WritePiece(i, data[begin:end])
+		task.Bitfield.SetPiece(i)
+	}
+	return task
+}
+
+// dialTask connects to the listener asking for infoSHA
+func dialTask(t *testing.T, ln *Listener, infoSHA [ShaLen]byte) (*PeerConn, *HandshakeMsg, error) {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(ln.Port()))
+	assert.Equal(t, nil, err)
+	var peerId [PeerIdLen]byte
+	_, err = NewHandShakeMsg(infoSHA, peerId).WriteHandshake(conn)
+	assert.Equal(t, nil, err)
+	res, err := ReadHandshake(conn)
+	return &PeerConn{Conn: conn, reader: bufio.NewReader(conn)}, res, err
+}
+
+func TestListener(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	a := newSeedTask([]byte("first torrent"), 4)
+	b := newSeedTask([]byte("second torrent"), 4)
+	ln.Add(a)
+	ln.Add(b)
+	defer a.Stop()
+	defer b.Stop()
+
+	peer, hs, err := dialTask(t, ln, b.InfoSHA)
+	assert.Equal(t, nil, err)
+	defer peer.Close()
+	assert.Equal(t, b.InfoSHA, hs.InfoSHA)
+	_, err = peer.WriteMsg(NewBitfieldMsg(NewBitfield(len(b.PieceSHA))))
+	assert.Equal(t, nil, err)
+
+	msg, err := peer.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, NewBitfieldMsg(b.Bitfield), msg)
+	msg, err = peer.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MsgNotInterest, msg.Id)
+
+	_, err = peer.WriteMsg(&PeerMsg{MsgInterested, nil})
+	assert.Equal(t, nil, err)
+	msg, err = peer.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MsgUnchoke, msg.Id)
+	_, err = peer.WriteMsg(NewRequestMsg(1, 0, 4))
+	assert.Equal(t, nil, err)
+	msg, err = peer.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, NewPieceMsg(1, 0, []byte("nd t")), msg)
+
+	// unknown torrents are hung up on
+	ln.Remove(a)
+	_, _, err = dialTask(t, ln, a.InfoSHA)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestAnnouncePort(t *testing.T) {
+	announce, err := announceUrl("http://tracker.example/announce", announceParams{port: 6881, left: 1})
+	assert.Equal(t, nil, err)
+	u, _ := url.Parse(announce)
+	assert.Equal(t, "6881", u.Query().Get("port"))
+}
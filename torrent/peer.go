@@ -1,12 +1,14 @@
 package torrent
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
+	"sync"
 	"time"
 )
 
@@ -54,57 +56,227 @@ type PeerConn struct {
 	peer     *PeerInfo
 	peerID   [PeerIdLen]byte
 	infoSHA  [ShaLen]byte
+	reader   *bufio.Reader
+	wmu      sync.Mutex // WriteMsg may be called from other goroutines, e.g. to send MsgHave
+
+	// upload side, smu guards the state the choker changes too
+	smu            sync.Mutex
+	amChoking      bool // whether we choke the remote peer
+	peerInterested bool // whether the remote peer wants something we have
+	requests       []blockRequest
+	cache          pieceCache
+
+	// bytes of blocks received from and sent to the peer, read by the choker
+	downloaded int64
+	uploaded   int64
+
+	// messages read in the background, see startReader
+	msgs      chan []*PeerMsg
+	pending   []*PeerMsg
+	readErr   error
+	done      chan struct{}
+	doneOnce  sync.Once
+	closeOnce sync.Once
+}
+
+func (c *PeerConn) AmChoking() bool {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	return c.amChoking
+}
+
+func (c *PeerConn) PeerInterested() bool {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	return c.peerInterested
 }
 
-func handshake(conn net.Conn, peerID [PeerIdLen]byte, infoSHA [ShaLen]byte) error {
+// setChoking chokes or unchokes the peer, telling it only if that changes
+func (c *PeerConn) setChoking(choke bool) error {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	if c.amChoking == choke {
+		return nil
+	}
+	c.amChoking = choke
+	id := MsgUnchoke
+	if choke {
+		id = MsgChoke
+	}
+	_, err := c.WriteMsg(&PeerMsg{id, nil})
+	return err
+}
+
+// handshake returns the handshake the peer answered ours with
+func handshake(conn net.Conn, peerID [PeerIdLen]byte, infoSHA [ShaLen]byte) (*HandshakeMsg, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 	// send HandshakeMsg
 	req := NewHandShakeMsg(infoSHA, peerID)
 	_, err := req.WriteHandshake(conn)
 	if err != nil {
-		return fmt.Errorf("send handshake failed: " + err.Error())
+		return nil, fmt.Errorf("send handshake failed: " + err.Error())
 	}
 
 	// read HandshakeMsg
 	res, err := ReadHandshake(conn)
 	if err != nil {
-		return fmt.Errorf("read handshake failed: " + err.Error())
+		return nil, fmt.Errorf("read handshake failed: " + err.Error())
 	}
 
 	// check HandshakeMsg
 	if !bytes.Equal(res.InfoSHA[:], infoSHA[:]) {
-		return fmt.Errorf("check handshake failed: " + string(res.InfoSHA[:]))
+		return nil, fmt.Errorf("check handshake failed: " + string(res.InfoSHA[:]))
 	}
-	return nil
+	// trackers may list us among the peers, as we announce our port
+	if res.PeerID == peerID {
+		return nil, fmt.Errorf("connected to ourselves")
+	}
+	return res, nil
 }
 
-func fillBitfield(c *PeerConn) error {
-	c.SetDeadline(time.Now().Add(5 * time.Second))
-	defer c.SetDeadline(time.Time{})
+// readBitfield reads the bitfield a peer may send first. Peers with no
+// piece are allowed to skip it, their bitfield is left empty then.
+func readBitfield(c *PeerConn, pieceCount int) error {
+	c.BitField = NewBitfield(pieceCount)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
 
-	msg, err := c.ReadMsg()
+	head, err := c.reader.Peek(int(LenBytes) + 1)
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
 		return err
 	}
-	if msg == nil {
-		return fmt.Errorf("expected bitfield")
+	if binary.BigEndian.Uint32(head) == 0 || MsgId(head[LenBytes]) != MsgBitfield {
+		return nil
+	}
+	maxLen := 1 + len(c.BitField)
+	if maxLen < MaxMsgLen {
+		maxLen = MaxMsgLen
 	}
-	if msg.Id != MsgBitfield {
-		return fmt.Errorf("expected bitfield, get %d", msg.Id)
+	msg, err := c.readMsg(maxLen)
+	if err != nil {
+		return err
 	}
-	fmt.Println("fill bitfield: " + c.peer.Ip.String())
 	c.BitField = msg.Payload
 	return nil
 }
 
 const LenBytes uint8 = 4
 
+// MaxMsgLen is the longest message we read, a MsgPiece carrying the largest
+// block we request. Only the bitfield of a big torrent may be longer.
+const MaxMsgLen = 1 + 8 + MaxBlockSize
+
+// writeTimeout is how long a write may block on a peer that stops reading
+const writeTimeout = 10 * time.Second
+
+// doneChan returns the channel closed when c is closed
+func (c *PeerConn) doneChan() chan struct{} {
+	c.doneOnce.Do(func() {
+		c.done = make(chan struct{})
+	})
+	return c.done
+}
+
+func (c *PeerConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.doneChan())
+	})
+	return c.Conn.Close()
+}
+
+// startReader reads the messages of the peer in the background, so that the
+// goroutine serving it can wait for other events too. Messages that arrive
+// together are delivered together, see waiting. Once the reader stops, the
+// error that stopped it is returned by recvMsg.
+func (c *PeerConn) startReader() {
+	if c.msgs != nil {
+		return
+	}
+	c.msgs = make(chan []*PeerMsg, 4)
+	done := c.doneChan()
+	go func() {
+		defer close(c.msgs)
+		for {
+			msg, err := c.ReadMsg()
+			if err != nil {
+				c.readErr = err
+				return
+			}
+			batch := []*PeerMsg{msg}
+			for c.msgBuffered() {
+				msg, err = c.ReadMsg()
+				if err != nil {
+					c.readErr = err
+					return
+				}
+				batch = append(batch, msg)
+			}
+			select {
+			case c.msgs <- batch:
+			case <-done:
+				c.readErr = net.ErrClosed
+				return
+			}
+		}
+	}()
+}
+
+// msgBuffered tells if a whole message is already buffered, so reading it
+// won't block
+func (c *PeerConn) msgBuffered() bool {
+	if c.reader.Buffered() < int(LenBytes) {
+		return false
+	}
+	head, _ := c.reader.Peek(int(LenBytes))
+	return c.reader.Buffered() >= int(LenBytes)+int(binary.BigEndian.Uint32(head))
+}
+
+// errInterrupted is returned by recvMsgUntil when it gave up waiting
+var errInterrupted = errors.New("interrupted")
+
+// recvMsg returns the next message read by startReader, `nil` on keep-alive
+func (c *PeerConn) recvMsg() (*PeerMsg, error) {
+	return c.recvMsgUntil(nil)
+}
+
+// recvMsgUntil is recvMsg giving up with errInterrupted once cancel is closed
+func (c *PeerConn) recvMsgUntil(cancel <-chan struct{}) (*PeerMsg, error) {
+	if len(c.pending) == 0 {
+		select {
+		case batch, ok := <-c.msgs:
+			if !ok {
+				return nil, c.readErr
+			}
+			c.pending = batch
+		case <-cancel:
+			return nil, errInterrupted
+		}
+	}
+	msg := c.pending[0]
+	c.pending = c.pending[1:]
+	return msg, nil
+}
+
+// waiting tells if a message already read is waiting for recvMsg
+func (c *PeerConn) waiting() bool {
+	return len(c.pending) > 0 || len(c.msgs) > 0
+}
+
 // ReadMsg parses a message from a stream. Returns `nil` on keep-alive message
 func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
+	return c.readMsg(MaxMsgLen)
+}
+
+// readMsg is ReadMsg rejecting messages longer than maxLen, before reading
+// them, so that a peer can't make us allocate any length it likes
+func (c *PeerConn) readMsg(maxLen int) (*PeerMsg, error) {
 	// read msg length
 	lenBuf := make([]byte, LenBytes)
-	_, err := io.ReadFull(c, lenBuf)
+	_, err := io.ReadFull(c.reader, lenBuf)
 	if err != nil {
 		return nil, fmt.Errorf("read message length error: %v", err)
 	}
@@ -113,10 +285,13 @@ func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > uint32(maxLen) {
+		return nil, fmt.Errorf("message too long: %d > %d", length, maxLen)
+	}
 
 	// read msg body
 	msgBuf := make([]byte, length)
-	_, err = io.ReadFull(c, msgBuf)
+	_, err = io.ReadFull(c.reader, msgBuf)
 	if err != nil {
 		return nil, fmt.Errorf("read message body error: %v", err)
 	}
@@ -129,45 +304,49 @@ func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
 
 // WriteMsg serializes a message into a buffer of the form
 // <4 bytes length><1 byte message ID><payload>
-// Interprets `nil` as a keep-alive message
+// Interprets `nil` as a keep-alive message. A write that doesn't complete
+// within writeTimeout closes the connection, the message may be cut.
 func (c *PeerConn) WriteMsg(m *PeerMsg) (int, error) {
-	if m == nil {
-		return c.Write(make([]byte, LenBytes))
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, LenBytes)
+	if m != nil {
+		length := uint32(len(m.Payload) + 1)
+		buf = make([]byte, length+4)
+		binary.BigEndian.PutUint32(buf[0:LenBytes], length)
+		buf[4] = byte(m.Id)
+		copy(buf[5:], m.Payload)
+	}
+	c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	n, err := c.Write(buf)
+	if err != nil {
+		c.Close()
 	}
-	length := uint32(len(m.Payload) + 1)
-	buf := make([]byte, length+4)
-	binary.BigEndian.PutUint32(buf[0:LenBytes], length)
-	buf[4] = byte(m.Id)
-	copy(buf[5:], m.Payload)
-	return c.Write(buf)
+	return n, err
 }
 
 func NewConn(peer *PeerInfo, infoSHA [ShaLen]byte, peerId [PeerIdLen]byte) (*PeerConn, error) {
 	// setup tcp connection
-	addr := net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
+	addr := peer.Addr()
 	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("set tcp conn failed: " + addr)
 	}
 	// torrent peer to peer handshake
-	err = handshake(conn, peerId, infoSHA)
+	res, err := handshake(conn, peerId, infoSHA)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	c := &PeerConn{
-		Conn:    conn,
-		Choked:  true,
-		peer:    peer,
-		peerID:  peerId,
-		infoSHA: infoSHA,
-	}
-	// fill bitfield
-	err = fillBitfield(c)
-	if err != nil {
-		return nil, fmt.Errorf("fill bitfield failed, " + err.Error())
-	}
-	return c, nil
+	return &PeerConn{
+		Conn:      conn,
+		Choked:    true,
+		amChoking: true,
+		peer:      peer,
+		peerID:    res.PeerID,
+		infoSHA:   infoSHA,
+		reader:    bufio.NewReader(conn),
+	}, nil
 }
 
 func NewRequestMsg(index, offset, length int) *PeerMsg {
@@ -178,6 +357,46 @@ func NewRequestMsg(index, offset, length int) *PeerMsg {
 	return &PeerMsg{MsgRequest, payload}
 }
 
+func NewCancelMsg(index, offset, length int) *PeerMsg {
+	msg := NewRequestMsg(index, offset, length)
+	msg.Id = MsgCancel
+	return msg
+}
+
+func NewHaveMsg(index int) *PeerMsg {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &PeerMsg{MsgHave, payload}
+}
+
+func NewBitfieldMsg(bf Bitfield) *PeerMsg {
+	payload := make([]byte, len(bf))
+	copy(payload, bf)
+	return &PeerMsg{MsgBitfield, payload}
+}
+
+func NewPieceMsg(index, offset int, data []byte) *PeerMsg {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(offset))
+	copy(payload[8:], data)
+	return &PeerMsg{MsgPiece, payload}
+}
+
+// GetRequest parses the payload of a MsgRequest or MsgCancel
+func GetRequest(msg *PeerMsg) (index, offset, length int, err error) {
+	if msg.Id != MsgRequest && msg.Id != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("expected MsgRequest or MsgCancel, got Id %d", msg.Id)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	offset = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, offset, length, nil
+}
+
 func GetHaveIndex(msg *PeerMsg) (int, error) {
 	if msg.Id != MsgHave {
 		return 0, fmt.Errorf("expected MsgHave (Id %d), got Id %d", MsgHave, msg.Id)
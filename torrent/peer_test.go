@@ -2,7 +2,9 @@ package torrent
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"github.com/stretchr/testify/assert"
 	"net"
 	"testing"
 )
@@ -23,3 +25,106 @@ func TestPeer(t *testing.T) {
 	}
 	fmt.Printf("%+v\n", conn)
 }
+
+func TestReadMsgTooLong(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	c := newTestConn(ours)
+	go func() {
+		head := make([]byte, LenBytes+1)
+		binary.BigEndian.PutUint32(head, 0xfffffff0)
+		head[LenBytes] = byte(MsgPiece)
+		theirs.Write(head)
+	}()
+	_, err := c.ReadMsg()
+	assert.NotEqual(t, nil, err)
+}
+
+func TestReadLongBitfield(t *testing.T) {
+	// a bitfield is accepted as long as the torrent needs, not longer
+	pieceCount := 8 * (MaxMsgLen + 100)
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	go func() {
+		bf := NewBitfield(pieceCount)
+		bf.SetPiece(pieceCount - 1)
+		theirs.Write(msgBytes(NewBitfieldMsg(bf)))
+	}()
+	c := newTestConn(ours)
+	assert.Equal(t, nil, readBitfield(c, pieceCount))
+	assert.Equal(t, true, c.BitField.HasPiece(pieceCount-1))
+
+	ours, theirs = net.Pipe()
+	defer theirs.Close()
+	go func() {
+		theirs.Write(msgBytes(NewBitfieldMsg(NewBitfield(pieceCount + 8))))
+	}()
+	assert.NotEqual(t, nil, readBitfield(newTestConn(ours), pieceCount))
+}
+
+func TestDialPeerWithoutBitfield(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	var infoSHA [ShaLen]byte
+	var peerId [PeerIdLen]byte
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := ReadHandshake(conn); err != nil {
+			return
+		}
+		NewHandShakeMsg(infoSHA, [PeerIdLen]byte{1}).WriteHandshake(conn)
+		// a peer with no piece goes on without a bitfield
+		conn.Write(msgBytes(&PeerMsg{MsgInterested, nil}))
+		conn.Read(make([]byte, 1))
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	c, err := NewConn(&PeerInfo{Ip: addr.IP, Port: uint16(addr.Port)}, infoSHA, peerId)
+	assert.Equal(t, nil, err)
+	defer c.Close()
+	assert.Equal(t, nil, readBitfield(c, 10))
+	assert.Equal(t, 0, c.BitField.Count())
+	msg, err := c.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MsgInterested, msg.Id)
+}
+
+func TestDialSelf(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	task := newSeedTask([]byte("some data"), 4)
+	ln.Add(task)
+	defer task.Stop()
+
+	// the listener hangs up on our own handshake
+	self := &PeerInfo{Ip: net.ParseIP("127.0.0.1"), Port: uint16(ln.Port())}
+	_, err = NewConn(self, task.InfoSHA, task.PeerId)
+	assert.NotEqual(t, nil, err)
+
+	// and so do we if a peer answers with our peer id
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hs, err := ReadHandshake(conn)
+		if err != nil {
+			return
+		}
+		hs.WriteHandshake(conn)
+		conn.Read(make([]byte, 1))
+	}()
+	addr := echo.Addr().(*net.TCPAddr)
+	_, err = NewConn(&PeerInfo{Ip: addr.IP, Port: uint16(addr.Port)}, task.InfoSHA, task.PeerId)
+	assert.EqualError(t, err, "connected to ourselves")
+}
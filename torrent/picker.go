@@ -0,0 +1,394 @@
+package torrent
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RandomFirstPieces is how many pieces are picked at random before going
+// rarest first, so that we quickly have whole pieces to trade
+const RandomFirstPieces = 4
+
+type pieceState uint8
+
+const (
+	pieceMissing pieceState = iota
+	pieceActive             // some of its blocks are handed out
+	pieceDone
+)
+
+type blockState uint8
+
+const (
+	blockMissing blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// partialPiece is a piece being downloaded block by block. The blocks
+// received are kept when the peers that requested the others leave.
+type partialPiece struct {
+	data     []byte
+	blocks   []blockState
+	requests []int // peers the block is requested from
+	received int
+}
+
+// piecePicker chooses which blocks each peer should request next. It counts
+// how many connected peers have each piece, from their bitfields and MsgHave.
+// The missing blocks of the pieces already started come first, so that they
+// are soon complete, then the rarest missing piece a peer has is started,
+// ties broken at random. Several peers may work on the same piece.
+//
+// Once every missing block is requested, the picker enters endgame mode:
+// peers are handed the blocks others are still waiting for, so that one slow
+// peer can't hold back the end of the download. When a block arrives, the
+// waiting peers are woken up to cancel their duplicate requests.
+type piecePicker struct {
+	mu           sync.Mutex
+	pieceLen     int
+	fileLen      int
+	availability []int
+	state        []pieceState
+	partial      []*partialPiece
+	attempts     []int // how many times each piece failed its hash check
+	missing      int   // blocks neither requested nor received
+	done         int
+	rand         *rand.Rand
+	wake         chan struct{} // closed when waiting peers may find a block
+}
+
+// newPiecePicker returns a picker for the pieces of a fileLen bytes torrent,
+// those in have being done
+func newPiecePicker(pieceLen, fileLen int, have Bitfield) *piecePicker {
+	pieceCount := (fileLen + pieceLen - 1) / pieceLen
+	pp := &piecePicker{
+		pieceLen:     pieceLen,
+		fileLen:      fileLen,
+		availability: make([]int, pieceCount),
+		state:        make([]pieceState, pieceCount),
+		partial:      make([]*partialPiece, pieceCount),
+		attempts:     make([]int, pieceCount),
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:         make(chan struct{}),
+	}
+	for i := range pp.state {
+		if have.HasPiece(i) {
+			pp.state[i] = pieceDone
+			pp.done++
+		} else {
+			pp.missing += pp.blockCount(i)
+		}
+	}
+	return pp
+}
+
+func (pp *piecePicker) pieceLength(index int) int {
+	begin, end, _ := pieceBounds(index, pp.pieceLen, pp.fileLen)
+	return end - begin
+}
+
+func (pp *piecePicker) blockCount(index int) int {
+	return (pp.pieceLength(index) + MaxBlockSize - 1) / MaxBlockSize
+}
+
+// block returns the request for block b of piece index
+func (pp *piecePicker) block(index, b int) blockRequest {
+	offset := b * MaxBlockSize
+	length := pp.pieceLength(index) - offset
+	if length > MaxBlockSize {
+		length = MaxBlockSize
+	}
+	return blockRequest{index, offset, length, pp.attempts[index]}
+}
+
+// addPeer counts the pieces of a newly connected peer
+func (pp *piecePicker) addPeer(bf Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for i := range pp.availability {
+		if bf.HasPiece(i) {
+			pp.availability[i]++
+		}
+	}
+}
+
+// removePeer forgets the pieces of a peer that left
+func (pp *piecePicker) removePeer(bf Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for i := range pp.availability {
+		if bf.HasPiece(i) && pp.availability[i] > 0 {
+			pp.availability[i]--
+		}
+	}
+}
+
+// have counts a piece a peer just got, it must not have had it before
+func (pp *piecePicker) have(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if index >= 0 && index < len(pp.availability) {
+		pp.availability[index]++
+	}
+}
+
+// pickBlocks hands out up to n blocks a peer having bf should request.
+// own are the blocks already requested from it, which it's never handed
+// again in endgame mode.
+func (pp *piecePicker) pickBlocks(bf Bitfield, n int, own []blockRequest) []blockRequest {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.missing == 0 {
+		return pp.pickEndgameLocked(bf, n, own)
+	}
+	var res []blockRequest
+	// finish the pieces already started first
+	for i, st := range pp.state {
+		if len(res) == n {
+			return res
+		}
+		if st == pieceActive && bf.HasPiece(i) {
+			res = pp.takeLocked(i, n, res)
+		}
+	}
+	for len(res) < n {
+		index, ok := pp.pickPieceLocked(bf)
+		if !ok {
+			break
+		}
+		pp.state[index] = pieceActive
+		pp.partial[index] = &partialPiece{
+			data:     make([]byte, pp.pieceLength(index)),
+			blocks:   make([]blockState, pp.blockCount(index)),
+			requests: make([]int, pp.blockCount(index)),
+		}
+		res = pp.takeLocked(index, n, res)
+	}
+	if pp.missing == 0 {
+		// peers waiting for a block may join the endgame
+		pp.wakeLocked()
+	}
+	return res
+}
+
+// takeLocked appends the missing blocks of a started piece to res, up to n
+func (pp *piecePicker) takeLocked(index, n int, res []blockRequest) []blockRequest {
+	p := pp.partial[index]
+	for b, st := range p.blocks {
+		if len(res) == n {
+			break
+		}
+		if st != blockMissing {
+			continue
+		}
+		p.blocks[b] = blockRequested
+		p.requests[b]++
+		pp.missing--
+		res = append(res, pp.block(index, b))
+	}
+	return res
+}
+
+// pickPieceLocked chooses the missing piece to start next
+func (pp *piecePicker) pickPieceLocked(bf Bitfield) (int, bool) {
+	randomFirst := pp.done < RandomFirstPieces
+	best, ties := -1, 0
+	for i, st := range pp.state {
+		if st != pieceMissing || !bf.HasPiece(i) {
+			continue
+		}
+		if best >= 0 && !randomFirst && pp.availability[i] > pp.availability[best] {
+			continue
+		}
+		if best < 0 || (!randomFirst && pp.availability[i] < pp.availability[best]) {
+			best, ties = i, 1
+			continue
+		}
+		// reservoir sampling keeps each equally good piece equally likely
+		ties++
+		if pp.rand.Intn(ties) == 0 {
+			best = i
+		}
+	}
+	return best, best >= 0
+}
+
+// pickEndgameLocked hands out the requested blocks the peer has, the ones
+// requested from the fewest peers first
+func (pp *piecePicker) pickEndgameLocked(bf Bitfield, n int, own []blockRequest) []blockRequest {
+	// blocks of an earlier attempt at a piece are the same for the peer
+	type block struct{ index, offset int }
+	mine := make(map[block]bool, len(own))
+	for _, req := range own {
+		mine[block{req.index, req.offset}] = true
+	}
+	type candidate struct {
+		req      blockRequest
+		requests int
+	}
+	var cands []candidate
+	for i, p := range pp.partial {
+		if p == nil || !bf.HasPiece(i) {
+			continue
+		}
+		for b, st := range p.blocks {
+			req := pp.block(i, b)
+			if st == blockRequested && !mine[block{i, req.offset}] {
+				cands = append(cands, candidate{req, p.requests[b]})
+			}
+		}
+	}
+	pp.rand.Shuffle(len(cands), func(i, j int) {
+		cands[i], cands[j] = cands[j], cands[i]
+	})
+	var res []blockRequest
+	for len(res) < n && len(cands) > 0 {
+		best := 0
+		for i := range cands {
+			if cands[i].requests < cands[best].requests {
+				best = i
+			}
+		}
+		req := cands[best].req
+		cands = append(cands[:best], cands[best+1:]...)
+		pp.partial[req.index].requests[req.offset/MaxBlockSize]++
+		res = append(res, req)
+	}
+	return res
+}
+
+// received stores a block that arrived. It returns false if the block wasn't
+// needed, e.g. another peer sent it first, and the data of the piece once
+// all its blocks are in, to be checked then finished or failed.
+func (pp *piecePicker) received(index, offset int, data []byte) ([]byte, bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if index < 0 || index >= len(pp.partial) || pp.partial[index] == nil || offset%MaxBlockSize != 0 {
+		return nil, false
+	}
+	p := pp.partial[index]
+	b := offset / MaxBlockSize
+	if b >= len(p.blocks) || p.blocks[b] == blockReceived || len(data) != pp.block(index, b).length {
+		return nil, false
+	}
+	if p.blocks[b] == blockMissing {
+		pp.missing--
+	}
+	if p.requests[b] > 1 {
+		// the other peers it was requested from should cancel it
+		pp.wakeLocked()
+	}
+	copy(p.data[offset:], data)
+	p.blocks[b] = blockReceived
+	p.requests[b] = 0
+	p.received++
+	if p.received < len(p.blocks) {
+		return nil, true
+	}
+	return p.data, true
+}
+
+// stale tells if a block requested from a peer is no longer needed
+func (pp *piecePicker) stale(req blockRequest) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	p := pp.partial[req.index]
+	return p == nil || req.attempt != pp.attempts[req.index] || p.blocks[req.offset/MaxBlockSize] == blockReceived
+}
+
+// release gives back blocks a peer won't send, they're missing again once
+// no peer is left they're requested from. Blocks of an earlier attempt at a
+// piece are no longer counted, they're ignored.
+func (pp *piecePicker) release(reqs []blockRequest) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	freed := false
+	for _, req := range reqs {
+		p := pp.partial[req.index]
+		if p == nil || req.attempt != pp.attempts[req.index] {
+			continue
+		}
+		b := req.offset / MaxBlockSize
+		if p.blocks[b] != blockRequested {
+			continue
+		}
+		p.requests[b]--
+		if p.requests[b] == 0 {
+			p.blocks[b] = blockMissing
+			pp.missing++
+			freed = true
+		}
+	}
+	if freed {
+		pp.wakeLocked()
+	}
+}
+
+// fail throws away a piece whose data doesn't match its hash. The next
+// attempt at it starts afresh: the requests of the failed one that peers
+// still wait for are stale.
+func (pp *piecePicker) fail(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.partial[index] == nil {
+		return
+	}
+	pp.partial[index] = nil
+	pp.attempts[index]++
+	pp.state[index] = pieceMissing
+	pp.missing += pp.blockCount(index)
+	pp.wakeLocked()
+}
+
+// finish marks a piece as saved
+func (pp *piecePicker) finish(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.state[index] == pieceDone {
+		return
+	}
+	if p := pp.partial[index]; p != nil {
+		for _, st := range p.blocks {
+			if st == blockMissing {
+				pp.missing--
+			}
+		}
+	} else {
+		pp.missing -= pp.blockCount(index)
+	}
+	pp.partial[index] = nil
+	pp.state[index] = pieceDone
+	pp.done++
+	if pp.done == len(pp.state) {
+		pp.wakeLocked()
+	}
+}
+
+func (pp *piecePicker) complete() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.done == len(pp.state)
+}
+
+// endgame tells if every missing block is requested
+func (pp *piecePicker) endgame() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.missing == 0 && pp.done < len(pp.state)
+}
+
+// waitChan returns a channel closed the next time blocks are given back,
+// a block arrives in endgame mode, or the download completes. Take it
+// before a pick, not to miss a wake up.
+func (pp *piecePicker) waitChan() chan struct{} {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.wake
+}
+
+func (pp *piecePicker) wakeLocked() {
+	close(pp.wake)
+	pp.wake = make(chan struct{})
+}
@@ -0,0 +1,403 @@
+package torrent
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func bitfieldOf(n int, pieces ...int) Bitfield {
+	bf := NewBitfield(n)
+	for _, i := range pieces {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+// newTestPicker returns a picker for n pieces of a single block
+func newTestPicker(n int, have Bitfield) *piecePicker {
+	pp := newPiecePicker(MaxBlockSize, n*MaxBlockSize, have)
+	pp.rand = rand.New(rand.NewSource(1))
+	return pp
+}
+
+// newRarestPicker returns a picker past the random first pieces
+func newRarestPicker(n int) *piecePicker {
+	have := NewBitfield(n + RandomFirstPieces)
+	for i := n; i < n+RandomFirstPieces; i++ {
+		have.SetPiece(i)
+	}
+	return newTestPicker(n+RandomFirstPieces, have)
+}
+
+// pick hands out the next piece of a single block
+func pick(pp *piecePicker, bf Bitfield) (int, bool) {
+	reqs := pp.pickBlocks(bf, 1, nil)
+	if len(reqs) == 0 {
+		return 0, false
+	}
+	return reqs[0].index, true
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	pp := newRarestPicker(4)
+	pp.addPeer(bitfieldOf(8, 0, 1, 2, 3))
+	pp.addPeer(bitfieldOf(8, 0, 1, 3))
+	pp.addPeer(bitfieldOf(8, 0, 3))
+
+	all := bitfieldOf(8, 0, 1, 2, 3)
+	index, ok := pick(pp, all)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 2, index)
+	index, _ = pick(pp, all)
+	assert.Equal(t, 1, index)
+
+	// a piece announced by MsgHave gets less rare
+	pp.have(0)
+	pp.removePeer(bitfieldOf(8, 0, 3))
+	index, _ = pick(pp, all)
+	assert.Equal(t, 3, index)
+	index, _ = pick(pp, all)
+	assert.Equal(t, 0, index)
+	// every block is requested now
+	assert.Equal(t, true, pp.endgame())
+}
+
+func TestPickOnlyPeerPieces(t *testing.T) {
+	pp := newRarestPicker(4)
+	pp.addPeer(bitfieldOf(8, 1))
+	pp.addPeer(bitfieldOf(8, 0, 1, 2, 3))
+
+	index, ok := pick(pp, bitfieldOf(8, 1, 3))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 3, index)
+	index, _ = pick(pp, bitfieldOf(8, 1, 3))
+	assert.Equal(t, 1, index)
+	_, ok = pick(pp, bitfieldOf(8, 1, 3))
+	assert.Equal(t, false, ok)
+	// pieces we already have are never picked
+	_, ok = pick(pp, bitfieldOf(8, 4, 5, 6, 7))
+	assert.Equal(t, false, ok)
+}
+
+func TestPickRandomFirst(t *testing.T) {
+	const n = 64
+	all := NewBitfield(n)
+	for i := 0; i < n; i++ {
+		all.SetPiece(i)
+	}
+	// piece 0 is the rarest, yet the first picks ignore availability
+	seen := make(map[int]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		pp := newTestPicker(n, nil)
+		pp.rand = rand.New(rand.NewSource(seed))
+		pp.addPeer(all)
+		pp.addPeer(bitfieldOf(n, 1, 2, 3))
+		pp.availability[0] = 0
+		index, ok := pick(pp, all)
+		assert.Equal(t, true, ok)
+		seen[index] = true
+	}
+	assert.Equal(t, true, len(seen) > 1)
+}
+
+func TestPickBlocks(t *testing.T) {
+	// two pieces of 3 blocks, the last block of each being short
+	const pieceLen = 2*MaxBlockSize + 100
+	data := make([]byte, 2*pieceLen)
+	rand.New(rand.NewSource(1)).Read(data)
+	pp := newPiecePicker(pieceLen, len(data), nil)
+	all := bitfieldOf(2, 0, 1)
+	pp.addPeer(all)
+	pp.addPeer(all)
+
+	first := pp.pickBlocks(all, 4, nil)
+	assert.Equal(t, 4, len(first))
+	index := first[0].index
+	assert.Equal(t, blockRequest{index, 0, MaxBlockSize, 0}, first[0])
+	assert.Equal(t, blockRequest{index, 2 * MaxBlockSize, 100, 0}, first[2])
+	assert.Equal(t, blockRequest{1 - index, 0, MaxBlockSize, 0}, first[3])
+
+	// the peer sends a block then leaves, the block is kept
+	piece, ok := pp.received(index, 0, data[index*pieceLen:index*pieceLen+MaxBlockSize])
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 0, len(piece))
+	pp.release(first[1:])
+
+	// the started pieces are finished first, by another peer
+	second := pp.pickBlocks(all, 10, nil)
+	assert.ElementsMatch(t, []blockRequest{first[1], first[2], first[3], {1 - index, MaxBlockSize, MaxBlockSize, 0}, {1 - index, 2 * MaxBlockSize, 100, 0}}, second)
+	_, ok = pp.received(index, 0, data[:MaxBlockSize])
+	assert.Equal(t, false, ok)
+	_, ok = pp.received(index, MaxBlockSize, data[:10])
+	assert.Equal(t, false, ok)
+	_, ok = pp.received(index, MaxBlockSize, data[index*pieceLen+MaxBlockSize:index*pieceLen+2*MaxBlockSize])
+	assert.Equal(t, true, ok)
+	piece, ok = pp.received(index, 2*MaxBlockSize, data[index*pieceLen+2*MaxBlockSize:(index+1)*pieceLen])
+	assert.Equal(t, true, ok)
+	assert.Equal(t, data[index*pieceLen:(index+1)*pieceLen], piece)
+
+	// a piece failing its hash check is downloaded again in full
+	pp.fail(index)
+	third := pp.pickBlocks(all, 10, second)
+	assert.Equal(t, 3, len(third))
+	assert.Equal(t, index, third[0].index)
+	pp.finish(index)
+	assert.Equal(t, true, pp.stale(third[0]))
+	assert.Equal(t, false, pp.complete())
+}
+
+func TestPickReleaseFinish(t *testing.T) {
+	// piece 2 is held by no peer, which keeps the picker out of endgame mode
+	pp := newTestPicker(3, nil)
+	all := bitfieldOf(3, 0, 1)
+	pp.addPeer(all)
+	first, _ := pick(pp, all)
+	second, _ := pick(pp, all)
+	wake := pp.waitChan()
+	_, ok := pick(pp, all)
+	assert.Equal(t, false, ok)
+
+	// a released block wakes the waiting peers up and can be picked again
+	pp.release([]blockRequest{pp.block(first, 0)})
+	select {
+	case <-wake:
+	default:
+		t.Fatal("release did not wake the peers up")
+	}
+	index, ok := pick(pp, all)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, first, index)
+
+	wake = pp.waitChan()
+	pp.finish(first)
+	pp.finish(second)
+	assert.Equal(t, false, pp.complete())
+	pp.finish(2)
+	assert.Equal(t, true, pp.complete())
+	select {
+	case <-wake:
+	default:
+		t.Fatal("completion did not wake the peers up")
+	}
+}
+
+func TestPickEndgame(t *testing.T) {
+	pp := newRarestPicker(3)
+	all := bitfieldOf(7, 0, 1, 2)
+	pp.addPeer(all)
+	pp.addPeer(all)
+	own := pp.pickBlocks(all, 2, nil)
+	assert.Equal(t, false, pp.endgame())
+	wake := pp.waitChan()
+	own = append(own, pp.pickBlocks(all, 2, own)...)
+	assert.Equal(t, 3, len(own))
+	assert.Equal(t, true, pp.endgame())
+	select {
+	case <-wake:
+	default:
+		t.Fatal("endgame did not wake the peers up")
+	}
+
+	// the blocks requested are handed out again, but not to the same peer
+	assert.Equal(t, 0, len(pp.pickBlocks(all, 5, own)))
+	dup := pp.pickBlocks(all, 5, nil)
+	assert.Equal(t, 3, len(dup))
+	assert.Equal(t, 0, len(pp.pickBlocks(bitfieldOf(7, 4), 5, nil)))
+
+	// the first copy to arrive wakes the other peers up to cancel theirs
+	wake = pp.waitChan()
+	_, ok := pp.received(own[0].index, 0, make([]byte, MaxBlockSize))
+	assert.Equal(t, true, ok)
+	select {
+	case <-wake:
+	default:
+		t.Fatal("received did not wake the peers up")
+	}
+	assert.Equal(t, true, pp.stale(own[0]))
+	assert.Equal(t, false, pp.stale(own[1]))
+	_, ok = pp.received(own[0].index, 0, make([]byte, MaxBlockSize))
+	assert.Equal(t, false, ok)
+
+	// a block left by one of its peers stays requested from the other
+	pp.release(own[1:2])
+	assert.Equal(t, true, pp.endgame())
+	pp.release(dup)
+	assert.Equal(t, false, pp.endgame())
+}
+
+func TestPickFailedAttempt(t *testing.T) {
+	pp := newTestPicker(1, nil)
+	all := bitfieldOf(1, 0)
+	first := pp.pickBlocks(all, 1, nil)
+	dup := pp.pickBlocks(all, 1, nil)
+	assert.Equal(t, first, dup)
+	_, ok := pp.received(0, 0, make([]byte, MaxBlockSize))
+	assert.Equal(t, true, ok)
+	pp.fail(0)
+
+	// the requests of the failed attempt don't count for the next one
+	again := pp.pickBlocks(all, 1, nil)
+	assert.Equal(t, 1, again[0].attempt)
+	assert.Equal(t, true, pp.stale(dup[0]))
+	assert.Equal(t, false, pp.stale(again[0]))
+	pp.release(dup)
+	assert.Equal(t, true, pp.endgame())
+	pp.release(again)
+	assert.Equal(t, false, pp.endgame())
+}
+
+func TestReceiveWrongLength(t *testing.T) {
+	pp := newTestPicker(2, nil)
+	all := bitfieldOf(2, 0, 1)
+	state := &taskState{t: &TorrentTask{}, pp: pp, conn: &PeerConn{}}
+	state.outstanding = pp.pickBlocks(all, 1, nil)
+	req := state.outstanding[0]
+
+	// a block of the wrong length is requested again, from any peer
+	err := state.handleMsg(NewPieceMsg(req.index, req.offset, make([]byte, 10)), nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(state.outstanding))
+	assert.Equal(t, int64(10), state.t.Wasted())
+	index, ok := pick(pp, bitfieldOf(2, req.index))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, req.index, index)
+}
+
+func TestDownloadNoPeer(t *testing.T) {
+	tf := newTestTorrent([]byte("some data"), 4, nil)
+	task := tf.newTorrentTask(6881)
+	task.Storage = NewMemStorage(tf)
+	task.StallTimeout = 100 * time.Millisecond
+	start := time.Now()
+	assert.NotEqual(t, nil, task.Download())
+	assert.Equal(t, true, time.Since(start) < 5*time.Second)
+	task.Stop()
+
+	// Stop ends a download waiting for peers too
+	task = tf.newTorrentTask(6881)
+	task.Storage = NewMemStorage(tf)
+	res := make(chan error)
+	go func() {
+		res <- task.Download()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	task.Stop()
+	select {
+	case err := <-res:
+		assert.NotEqual(t, nil, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not return after Stop")
+	}
+}
+
+func TestDownloadFromSeeds(t *testing.T) {
+	// pieces of several blocks, which both seeds work on
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(data)
+	const pieceLen = 2*MaxBlockSize + 1000
+
+	task := newSeedTask(data, pieceLen)
+	storage := NewMemStorage(newTestTorrent(data, pieceLen, nil))
+	task.Storage = storage
+	task.Bitfield = nil
+	task.PeerMap = make(map[string]*PeerInfo)
+	for i := 0; i < 2; i++ {
+		ln, err := Listen("127.0.0.1:0")
+		assert.Equal(t, nil, err)
+		defer ln.Close()
+		seed := newSeedTask(data, pieceLen)
+		ln.Add(seed)
+		defer seed.Stop()
+		addr := "127.0.0.1:" + strconv.Itoa(ln.Port())
+		task.PeerMap[addr] = &PeerInfo{Ip: net.ParseIP("127.0.0.1"), Port: uint16(ln.Port())}
+	}
+
+	err := task.Download()
+	task.Stop()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Equal(data, storage.Bytes()))
+}
+
+// stallPeer serves a torrent it pretends to have in full, but never sends a
+// block. The cancelled requests are sent on cancels.
+func stallPeer(t *testing.T, pieceCount int, cancels chan int) *PeerInfo {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := ReadHandshake(conn)
+		if err != nil {
+			return
+		}
+		var peerId [PeerIdLen]byte
+		NewHandShakeMsg(req.InfoSHA, peerId).WriteHandshake(conn)
+		c := newTestConn(conn)
+		bf := NewBitfield(pieceCount)
+		for i := 0; i < pieceCount; i++ {
+			bf.SetPiece(i)
+		}
+		c.WriteMsg(NewBitfieldMsg(bf))
+		c.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+		for {
+			msg, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.Id == MsgCancel {
+				index, _, _, _ := GetRequest(msg)
+				cancels <- index
+			}
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return &PeerInfo{Ip: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestEndgame(t *testing.T) {
+	data := make([]byte, 40000)
+	rand.New(rand.NewSource(1)).Read(data)
+	const pieceLen = 4096
+
+	task := newSeedTask(data, pieceLen)
+	storage := NewMemStorage(newTestTorrent(data, pieceLen, nil))
+	task.Storage = storage
+	task.Bitfield = nil
+	cancels := make(chan int, 16)
+	task.PeerMap = map[string]*PeerInfo{"stall": stallPeer(t, len(task.PieceSHA), cancels)}
+
+	// the seed is added once the stalled peer holds a piece
+	ln, err := Listen("127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	seed := newSeedTask(data, pieceLen)
+	ln.Add(seed)
+	defer seed.Stop()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		// the key of the stalled peer is "stall", not its IP
+		task.AddPeers([]*PeerInfo{{Ip: net.ParseIP("127.0.0.1"), Port: uint16(ln.Port())}})
+	}()
+
+	start := time.Now()
+	err = task.Download()
+	assert.Equal(t, nil, err)
+	// without endgame mode, the stalled piece would wait for the 15s timeout
+	assert.Equal(t, true, time.Since(start) < 5*time.Second)
+	assert.Equal(t, true, bytes.Equal(data, storage.Bytes()))
+	select {
+	case <-cancels:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stalled requests were not cancelled")
+	}
+	task.Stop()
+}
@@ -0,0 +1,113 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/berylyvos/gorrent/bencode"
+	"os"
+	"path/filepath"
+)
+
+// resumeFile records the size a file of the torrent had when saved
+type resumeFile struct {
+	Length int    `bencode:"length"`
+	Path   string `bencode:"path"`
+}
+
+// resumeData is the fast-resume record kept next to the download, so that
+// an interrupted download can skip the pieces it already saved
+type resumeData struct {
+	InfoHash []byte       `bencode:"info-hash,required"`
+	Pieces   []byte       `bencode:"pieces,required"` // bitfield of saved pieces
+	Files    []resumeFile `bencode:"files,required"`
+}
+
+// resumePath returns where the resume record of a download to path lives:
+// beside the file of a single-file torrent or the directory of a multi-file one
+func resumePath(path string, tf *TorrentFile) string {
+	if tf.FileList != nil {
+		path = filepath.Join(path, tf.FileName)
+	}
+	return path + ".resume"
+}
+
+// resumeFiles lists the files of the torrent in the resume record
+func resumeFiles(fileName string, fileLen int, fileList []File) []resumeFile {
+	if fileList == nil {
+		return []resumeFile{{Length: fileLen, Path: fileName}}
+	}
+	res := make([]resumeFile, len(fileList))
+	for i, f := range fileList {
+		res[i] = resumeFile{Length: f.Length, Path: f.Path}
+	}
+	return res
+}
+
+// saveResume writes the resume record of t. It writes to a temporary file
+// first, so a crash never leaves a half written record behind.
+func (t *TorrentTask) saveResume() error {
+	rd := &resumeData{
+		InfoHash: t.InfoSHA[:],
+		Pieces:   t.Bitfield,
+		Files:    resumeFiles(t.FileName, t.FileLen, t.FileList),
+	}
+	buf := new(bytes.Buffer)
+	err := bencode.NewEncoder(buf).Encode(rd)
+	if err != nil {
+		return err
+	}
+	tmp := t.ResumePath + ".tmp"
+	err = os.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.ResumePath)
+}
+
+// loadResume returns the pieces the resume record at path says are saved
+// under the files of layout. A missing or stale record, e.g. one for another
+// torrent or whose files changed size since, yields an empty bitfield.
+func loadResume(path string, tf *TorrentFile, files layout) Bitfield {
+	empty := NewBitfield(len(tf.PieceSHA))
+	file, err := os.Open(path)
+	if err != nil {
+		return empty
+	}
+	defer file.Close()
+
+	rd := new(resumeData)
+	err = bencode.Unmarshal(file, rd)
+	if err != nil {
+		fmt.Println("ignore broken resume file: " + err.Error())
+		return empty
+	}
+	if !rd.matches(tf) {
+		fmt.Println("ignore resume file of another torrent: " + path)
+		return empty
+	}
+	for i, f := range files {
+		info, err := os.Stat(f.path)
+		if err != nil || info.Size() != int64(rd.Files[i].Length) {
+			fmt.Println("ignore resume file, data changed: " + f.path)
+			return empty
+		}
+	}
+	return Bitfield(rd.Pieces)
+}
+
+// matches tells if the record was written for the download of tf
+func (rd *resumeData) matches(tf *TorrentFile) bool {
+	if !bytes.Equal(rd.InfoHash, tf.InfoSHA[:]) || len(rd.Pieces) != (len(tf.PieceSHA)+7)/8 {
+		return false
+	}
+	expect := resumeFiles(tf.FileName, tf.FileLen, tf.FileList)
+	if len(rd.Files) != len(expect) {
+		return false
+	}
+	for i := range expect {
+		if rd.Files[i] != expect[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestTorrent returns a multi-file torrent of data split in pieces of pieceLen
+func newTestTorrent(data []byte, pieceLen int, files []File) *TorrentFile {
+	tf := &TorrentFile{
+		InfoSHA:  sha1.Sum(data),
+		FileName: "name",
+		FileLen:  len(data),
+		PieceLen: pieceLen,
+		FileList: files,
+		HasMulti: files != nil,
+	}
+	for begin := 0; begin < len(data); begin += pieceLen {
+		end := begin + pieceLen
+		if end > len(data) {
+			end = len(data)
+		}
+		tf.PieceSHA = append(tf.PieceSHA, sha1.Sum(data[begin:end]))
+	}
+	return tf
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("0123456789")
+	tf := newTestTorrent(data, 4, []File{{Length: 6, Path: "a"}, {Length: 4, Path: "b/c"}})
+	files, _ := newLayout(dir, tf.FileName, tf.FileLen, tf.FileList)
+	path := resumePath(dir, tf)
+	assert.Equal(t, filepath.Join(dir, "name.resume"), path)
+
+	// no record yet
+	assert.Equal(t, 0, loadResume(path, tf, files).Count())
+
+	storage, err := NewFileStorage(dir, tf)
+	assert.Equal(t, nil, err)
+	defer storage.Close()
+	task := &TorrentTask{
+		InfoSHA:    tf.InfoSHA,
+		FileName:   tf.FileName,
+		FileLen:    tf.FileLen,
+		FileList:   tf.FileList,
+		Bitfield:   NewBitfield(3),
+		ResumePath: path,
+	}
+	assert.Equal(t, nil, storage.WritePiece(0, data[0:4]))
+	assert.Equal(t, nil, storage.WritePiece(2, data[8:]))
+	task.Bitfield.SetPiece(0)
+	task.Bitfield.SetPiece(2)
+	assert.Equal(t, nil, task.saveResume())
+
+	done := loadResume(path, tf, files)
+	assert.Equal(t, 2, done.Count())
+	assert.Equal(t, true, done.HasPiece(2))
+
+	// a file changed size since the record was saved
+	assert.Equal(t, nil, os.Truncate(files[1].path, 2))
+	assert.Equal(t, 0, loadResume(path, tf, files).Count())
+	assert.Equal(t, nil, os.Truncate(files[1].path, 4))
+
+	// the record of another torrent is ignored
+	other := newTestTorrent([]byte("abcdefghij"), 4, tf.FileList)
+	assert.Equal(t, 0, loadResume(path, other, files).Count())
+	assert.Equal(t, 2, loadResume(path, tf, files).Count())
+
+	assert.Equal(t, nil, os.WriteFile(path, []byte("garbage"), 0644))
+	assert.Equal(t, 0, loadResume(path, tf, files).Count())
+}
+
+func TestBitfield(t *testing.T) {
+	bf := NewBitfield(10)
+	assert.Equal(t, 2, len(bf))
+	bf.SetPiece(1)
+	bf.SetPiece(9)
+	bf.SetPiece(16)
+	assert.Equal(t, 2, bf.Count())
+	bf.ClearPiece(1)
+	assert.Equal(t, false, bf.HasPiece(1))
+	assert.Equal(t, true, bf.HasPiece(9))
+	assert.Equal(t, 1, bf.Count())
+}
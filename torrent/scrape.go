@@ -0,0 +1,227 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/berylyvos/gorrent/bencode"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxUDPScrape is how many info hashes fit in a UDP scrape request
+const MaxUDPScrape = 74
+
+// ScrapeResult is the swarm of a torrent as a tracker sees it
+type ScrapeResult struct {
+	Seeders   int // peers having the whole torrent
+	Leechers  int // peers still downloading
+	Completed int // downloads the tracker saw complete
+}
+
+// TrackerScrape is what one tracker of a torrent tells about its swarm
+type TrackerScrape struct {
+	Url string
+	ScrapeResult
+	Err error
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type HTTPScrapeResp struct {
+	FailureReason string                `bencode:"failure reason,omitempty"`
+	Files         map[string]scrapeFile `bencode:"files"`
+}
+
+// Scrape asks the tracker at trackerUrl, HTTP or UDP, about the swarms of
+// infoHashes. The hashes the tracker doesn't know are left out of the result.
+func Scrape(trackerUrl string, infoHashes ...[ShaLen]byte) (map[[ShaLen]byte]ScrapeResult, error) {
+	tr, err := newTracker(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+	return tr.scrape(infoHashes)
+}
+
+// Scrape asks every tracker of the torrent about its swarm at once, and
+// returns their answers tier by tier
+func (tf *TorrentFile) Scrape() []TrackerScrape {
+	var res []TrackerScrape
+	for _, tier := range tf.announceTiers() {
+		for _, u := range tier {
+			res = append(res, TrackerScrape{Url: u})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range res {
+		wg.Add(1)
+		go func(ts *TrackerScrape) {
+			defer wg.Done()
+			files, err := Scrape(ts.Url, tf.InfoSHA)
+			if err != nil {
+				ts.Err = err
+				return
+			}
+			r, ok := files[tf.InfoSHA]
+			if !ok {
+				ts.Err = errors.New("torrent unknown to tracker")
+				return
+			}
+			ts.ScrapeResult = r
+		}(&res[i])
+	}
+	wg.Wait()
+	return res
+}
+
+// scrapeUrl derives the scrape url of an HTTP tracker from its announce url:
+// by convention, `announce` in the last path element is replaced by `scrape`
+func scrapeUrl(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", fmt.Errorf("tracker %v doesn't support scrape", announce)
+	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+func (tr httpTracker) scrape(infoHashes [][ShaLen]byte) (map[[ShaLen]byte]ScrapeResult, error) {
+	scrape, err := scrapeUrl(string(tr))
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(scrape)
+	params := u.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	cli := &http.Client{Timeout: time.Duration(RetrievePeersTimeout) * time.Second}
+	resp, err := cli.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to tracker: %v", err)
+	}
+	scrapeResp := new(HTTPScrapeResp)
+	dec := bencode.NewDecoder(resp.Body)
+	dec.SetOptions(trackerDecodeOptions)
+	err = dec.Decode(scrapeResp)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("tracker response error: %v", err)
+	}
+	if scrapeResp.FailureReason != "" {
+		return nil, &TrackerFailure{Reason: scrapeResp.FailureReason}
+	}
+
+	res := make(map[[ShaLen]byte]ScrapeResult)
+	for key, f := range scrapeResp.Files {
+		if len(key) != ShaLen {
+			continue
+		}
+		var h [ShaLen]byte
+		copy(h[:], key)
+		res[h] = ScrapeResult{
+			Seeders:   f.Complete,
+			Leechers:  f.Incomplete,
+			Completed: f.Downloaded,
+		}
+	}
+	return res, nil
+}
+
+func (tr UDPTracker) scrape(infoHashes [][ShaLen]byte) (map[[ShaLen]byte]ScrapeResult, error) {
+	socket, err := tr.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = socket.Close() }()
+
+	connId, err := udpConnect(socket)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[[ShaLen]byte]ScrapeResult)
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > MaxUDPScrape {
+			batch = batch[:MaxUDPScrape]
+		}
+		infoHashes = infoHashes[len(batch):]
+		err = udpScrape(socket, connId, batch, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// udpScrape scrapes a batch of at most MaxUDPScrape info hashes into res
+func udpScrape(socket *net.UDPConn, connId uint64, infoHashes [][ShaLen]byte, res map[[ShaLen]byte]ScrapeResult) error {
+	// scrape request:
+	//
+	// Offset          Size            Name            Value
+	// 0               64-bit integer  connection_id
+	// 8               32-bit integer  action          2 // scrape
+	// 12              32-bit integer  transaction_id
+	// 16 + 20 * n     20-byte string  info_hash
+	// 16 + 20 * N
+	transId := uint32(genTransactionID())
+	payload := make([]byte, 16, 16+ShaLen*len(infoHashes))
+	binary.BigEndian.PutUint64(payload[0:8], connId)
+	binary.BigEndian.PutUint32(payload[8:12], uint32(ActionScrape))
+	binary.BigEndian.PutUint32(payload[12:16], transId)
+	for _, h := range infoHashes {
+		payload = append(payload, h[:]...)
+	}
+	_, err := socket.Write(payload)
+	if err != nil {
+		return fmt.Errorf("scrape write payload error: %v", err)
+	}
+	// scrape response:
+	//
+	// Offset      Size            Name            Value
+	// 0           32-bit integer  action          2 // scrape
+	// 4           32-bit integer  transaction_id
+	// 8 + 12 * n  32-bit integer  seeders
+	// 12 + 12 * n 32-bit integer  completed
+	// 16 + 12 * n 32-bit integer  leechers
+	// 8 + 12 * N
+	data := make([]byte, 8+12*len(infoHashes))
+	_ = socket.SetReadDeadline(time.Now().Add(time.Duration(RetrievePeersTimeout) * time.Second))
+	n, err := socket.Read(data)
+	if err != nil {
+		return fmt.Errorf("scrape read from udp error: %v", err)
+	}
+	if n < 8 || binary.BigEndian.Uint32(data[4:8]) != transId {
+		return errors.New("scrape response error")
+	}
+	if binary.BigEndian.Uint32(data[:4]) == ActionError {
+		return &TrackerFailure{Reason: string(data[8:n])}
+	}
+	if binary.BigEndian.Uint32(data[:4]) != ActionScrape || n != len(data) {
+		return errors.New("scrape response error")
+	}
+	for i, h := range infoHashes {
+		off := 8 + 12*i
+		res[h] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(data[off : off+4])),
+			Completed: int(binary.BigEndian.Uint32(data[off+4 : off+8])),
+			Leechers:  int(binary.BigEndian.Uint32(data[off+8 : off+12])),
+		}
+	}
+	return nil
+}
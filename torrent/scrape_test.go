@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestScrapeUrl(t *testing.T) {
+	u, err := scrapeUrl("http://example.com/announce")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "http://example.com/scrape", u)
+	u, err = scrapeUrl("http://example.com/x/announce.php?passkey=abc")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "http://example.com/x/scrape.php?passkey=abc", u)
+	_, err = scrapeUrl("http://example.com/a")
+	assert.NotEqual(t, nil, err)
+	_, err = scrapeUrl("http://example.com/announce/x")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	var known, unknown [ShaLen]byte
+	copy(known[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(unknown[:], "bbbbbbbbbbbbbbbbbbbb")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/scrape", r.URL.Path)
+		assert.Equal(t, []string{string(known[:]), string(unknown[:])}, r.URL.Query()["info_hash"])
+		w.Write([]byte("d5:filesd20:" + string(known[:]) + "d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer srv.Close()
+
+	res, err := Scrape(srv.URL+"/announce", known, unknown)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[[ShaLen]byte]ScrapeResult{known: {Seeders: 5, Leechers: 10, Completed: 50}}, res)
+}
+
+func TestScrapeHTTPFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason9:forbiddene"))
+	}))
+	defer srv.Close()
+
+	_, err := Scrape(srv.URL+"/announce", [ShaLen]byte{})
+	assert.Equal(t, &TrackerFailure{Reason: "forbidden"}, err)
+}
+
+func TestScrapeUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	batches := make(chan int, 8)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			trans := buf[12:16]
+			if action == ActionConnect && n == 16 {
+				resp := make([]byte, 16)
+				copy(resp[4:8], trans)
+				binary.BigEndian.PutUint64(resp[8:16], 42)
+				conn.WriteToUDP(resp, addr)
+				continue
+			}
+			if action != ActionScrape || binary.BigEndian.Uint64(buf[0:8]) != 42 || (n-16)%ShaLen != 0 {
+				continue
+			}
+			count := (n - 16) / ShaLen
+			batches <- count
+			resp := make([]byte, 8+12*count)
+			binary.BigEndian.PutUint32(resp[0:4], ActionScrape)
+			copy(resp[4:8], trans)
+			for i := 0; i < count; i++ {
+				// the first byte of each test hash is its number
+				h := uint32(buf[16+ShaLen*i])
+				binary.BigEndian.PutUint32(resp[8+12*i:], h)
+				binary.BigEndian.PutUint32(resp[12+12*i:], 2*h)
+				binary.BigEndian.PutUint32(resp[16+12*i:], 3*h)
+			}
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	hashes := make([][ShaLen]byte, MaxUDPScrape+6)
+	for i := range hashes {
+		hashes[i][0] = byte(i)
+	}
+	res, err := Scrape("udp://127.0.0.1:"+strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port), hashes...)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MaxUDPScrape, <-batches)
+	assert.Equal(t, 6, <-batches)
+	assert.Equal(t, len(hashes), len(res))
+	for i, h := range hashes {
+		assert.Equal(t, ScrapeResult{Seeders: i, Completed: 2 * i, Leechers: 3 * i}, res[h])
+	}
+}
+
+func TestTorrentScrape(t *testing.T) {
+	tf := newTestTorrent([]byte("some data"), 8, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:filesd20:" + string(tf.InfoSHA[:]) + "d8:completei1e10:downloadedi3e10:incompletei2eeee"))
+	}))
+	defer srv.Close()
+	tf.AnnounceTiers = [][]string{{srv.URL + "/announce"}, {srv.URL + "/a"}}
+
+	res := tf.Scrape()
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, TrackerScrape{Url: srv.URL + "/announce", ScrapeResult: ScrapeResult{1, 2, 3}}, res[0])
+	assert.Equal(t, srv.URL+"/a", res[1].Url)
+	assert.NotEqual(t, nil, res[1].Err)
+}
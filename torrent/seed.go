@@ -0,0 +1,298 @@
+package torrent
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// MaxRequestLen is the largest block a peer may ask us for, bigger requests
+// are dropped as most clients do
+const MaxRequestLen = 128 << 10
+
+// MaxPendingRequests bounds the requests queued for a peer
+const MaxPendingRequests = 256
+
+// seedTimeout drops a seeding peer that sent nothing, not even a keep-alive
+const seedTimeout = 3 * time.Minute
+
+// blockRequest is a block a peer asked us for, or we ask a peer for
+type blockRequest struct {
+	index   int
+	offset  int
+	length  int
+	attempt int // the attempt at the piece it's requested for, see piecePicker.fail
+}
+
+// pieceCache keeps the last piece read from storage, since peers ask for
+// a piece block by block
+type pieceCache struct {
+	index int
+	data  []byte
+}
+
+// hasPiece and setPiece guard t.Bitfield, which the peer goroutines read
+// while Download fills it
+func (t *TorrentTask) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Bitfield.HasPiece(index)
+}
+
+func (t *TorrentTask) setPiece(index int) {
+	t.mu.Lock()
+	t.Bitfield.SetPiece(index)
+	t.mu.Unlock()
+	t.broadcast(NewHaveMsg(index))
+}
+
+func (t *TorrentTask) complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Bitfield.Count() == len(t.PieceSHA)
+}
+
+// Uploaded returns the number of bytes served to peers so far
+func (t *TorrentTask) Uploaded() int64 {
+	return atomic.LoadInt64(&t.uploaded)
+}
+
+// initLocked sets up what the peer goroutines share
+func (t *TorrentTask) initLocked() {
+	if t.stop == nil {
+		t.stop = make(chan struct{})
+	}
+	if t.completed == nil {
+		t.completed = make(chan struct{})
+	}
+	if t.choker == nil {
+		t.choker = newChoker(t.Choke, realClock{})
+	}
+}
+
+// startLocked also starts the choker rounds, once
+func (t *TorrentTask) startLocked() {
+	t.initLocked()
+	if t.started {
+		return
+	}
+	t.started = true
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.choker.run(t, t.stop)
+	}()
+}
+
+func (t *TorrentTask) getChoker() *choker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.initLocked()
+	return t.choker
+}
+
+// peers returns the connected peers
+func (t *TorrentTask) peers() []*PeerConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make([]*PeerConn, 0, len(t.conns))
+	for c := range t.conns {
+		res = append(res, c)
+	}
+	return res
+}
+
+// addConn registers a connected peer to get our MsgHave, or returns false
+// once the task is stopped
+func (t *TorrentTask) addConn(c *PeerConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.addConnLocked(c)
+}
+
+// joinConn is addConn for the peers that connect to us, it also counts them
+// in t.wg under the lock, so that it never races with the wg.Wait of Stop.
+// Peers we are connected to already, e.g. ones we dialed, are refused.
+func (t *TorrentTask) joinConn(c *PeerConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.PeerMap[c.peer.Addr()]; ok {
+		return false
+	}
+	for other := range t.conns {
+		if other.peerID == c.peerID {
+			return false
+		}
+	}
+	if !t.addConnLocked(c) {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *TorrentTask) addConnLocked(c *PeerConn) bool {
+	select {
+	case <-t.stop:
+		return false
+	default:
+	}
+	if t.conns == nil {
+		t.conns = make(map[*PeerConn]struct{})
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *TorrentTask) removeConn(c *PeerConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+	c.Close()
+}
+
+// broadcast sends msg to every connected peer
+func (t *TorrentTask) broadcast(msg *PeerMsg) {
+	for _, c := range t.peers() {
+		c.WriteMsg(msg)
+	}
+}
+
+// sendBitfield tells a newly connected peer which pieces we have, it must be
+// the first message after the handshake
+func (t *TorrentTask) sendBitfield(c *PeerConn) error {
+	t.mu.Lock()
+	if t.Bitfield.Count() == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	msg := NewBitfieldMsg(t.Bitfield)
+	t.mu.Unlock()
+	_, err := c.WriteMsg(msg)
+	return err
+}
+
+// handleUpload handles the messages about what the peer wants from us
+func (t *TorrentTask) handleUpload(c *PeerConn, msg *PeerMsg) error {
+	switch msg.Id {
+	case MsgInterested:
+		c.smu.Lock()
+		c.peerInterested = true
+		c.smu.Unlock()
+		t.getChoker().interested(c)
+	case MsgNotInterest:
+		c.smu.Lock()
+		c.peerInterested = false
+		c.smu.Unlock()
+	case MsgRequest:
+		index, offset, length, err := GetRequest(msg)
+		if err != nil {
+			return err
+		}
+		// requests of choked peers are dropped, as the spec says
+		if c.AmChoking() || !t.validRequest(index, offset, length) || len(c.requests) >= MaxPendingRequests {
+			return nil
+		}
+		c.requests = append(c.requests, blockRequest{index: index, offset: offset, length: length})
+	case MsgCancel:
+		index, offset, length, err := GetRequest(msg)
+		if err != nil {
+			return err
+		}
+		req := blockRequest{index: index, offset: offset, length: length}
+		for i, r := range c.requests {
+			if r == req {
+				c.requests = append(c.requests[:i], c.requests[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// validRequest tells if a block lies inside a piece we have
+func (t *TorrentTask) validRequest(index, offset, length int) bool {
+	if index < 0 || index >= len(t.PieceSHA) || length <= 0 || length > MaxRequestLen {
+		return false
+	}
+	begin, end := t.getPieceBounds(index)
+	return offset >= 0 && offset+length <= end-begin && t.hasPiece(index)
+}
+
+// serveRequest sends the oldest block the peer asked for. It's called only
+// when no message is waiting to be read, so that a MsgCancel can still catch
+// the requests queued before it.
+func (t *TorrentTask) serveRequest(c *PeerConn) error {
+	if len(c.requests) == 0 || c.waiting() {
+		return nil
+	}
+	// the requests of a peer we choked since are dropped
+	if c.AmChoking() {
+		c.requests = nil
+		return nil
+	}
+	req := c.requests[0]
+	c.requests = c.requests[1:]
+	if c.cache.data == nil || c.cache.index != req.index {
+		data, err := t.Storage.ReadPiece(req.index)
+		if err != nil {
+			return fmt.Errorf("read piece #%d error: %v", req.index, err)
+		}
+		c.cache = pieceCache{req.index, data}
+	}
+	block := c.cache.data[req.offset : req.offset+req.length]
+	_, err := c.WriteMsg(NewPieceMsg(req.index, req.offset, block))
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.uploaded, int64(req.length))
+	atomic.AddInt64(&c.uploaded, int64(req.length))
+	return nil
+}
+
+// seedRoutine keeps serving a peer once there is nothing left to download
+// from it, until either side hangs up or the task is stopped
+func (t *TorrentTask) seedRoutine(c *PeerConn, pp *piecePicker) {
+	c.startReader()
+	if t.complete() {
+		c.WriteMsg(&PeerMsg{MsgNotInterest, nil})
+	}
+	for {
+		if len(c.requests) > 0 && !c.waiting() {
+			if err := t.serveRequest(c); err != nil {
+				fmt.Println("failed to serve peer: " + err.Error())
+				return
+			}
+			continue
+		}
+		c.SetReadDeadline(time.Now().Add(seedTimeout))
+		msg, err := c.recvMsg()
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		if _, err := t.handlePeerMsg(c, pp, msg); err != nil {
+			fmt.Println("failed to serve peer: " + err.Error())
+			return
+		}
+	}
+}
+
+// Stop disconnects every peer and waits for their goroutines to end. It's
+// how a task stops seeding after Download returns.
+func (t *TorrentTask) Stop() {
+	t.mu.Lock()
+	t.initLocked()
+	select {
+	case <-t.stop:
+	default:
+		close(t.stop)
+	}
+	for c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
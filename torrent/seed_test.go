@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func newTestConn(conn net.Conn) *PeerConn {
+	return &PeerConn{
+		Conn:      conn,
+		Choked:    true,
+		amChoking: true,
+		reader:    bufio.NewReader(conn),
+	}
+}
+
+// msgBytes serializes msgs as WriteMsg does, so they can be sent in one write
+func msgBytes(msgs ...*PeerMsg) []byte {
+	buf := new(bytes.Buffer)
+	for _, m := range msgs {
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(m.Payload)+1))
+		buf.WriteByte(byte(m.Id))
+		buf.Write(m.Payload)
+	}
+	return buf.Bytes()
+}
+
+func TestSeedRoutine(t *testing.T) {
+	tf := &TorrentFile{FileLen: 10, PieceLen: 4, PieceSHA: make([][ShaLen]byte, 3)}
+	storage := NewMemStorage(tf)
+	_ = storage.WritePiece(0, []byte("abcd"))
+	_ = storage.WritePiece(1, []byte("efgh"))
+	task := &TorrentTask{
+		FileLen:  tf.FileLen,
+		PieceLen: tf.PieceLen,
+		PieceSHA: tf.PieceSHA,
+		Storage:  storage,
+		Bitfield: NewBitfield(3),
+	}
+	task.Bitfield.SetPiece(0)
+	task.Bitfield.SetPiece(1)
+
+	ours, theirs := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		task.seedRoutine(newTestConn(ours), nil)
+		close(done)
+	}()
+	peer := newTestConn(theirs)
+
+	// a request before we unchoke the peer is dropped
+	_, err := peer.Write(msgBytes(NewRequestMsg(0, 0, 4), &PeerMsg{MsgInterested, nil}))
+	assert.Equal(t, nil, err)
+	msg, err := peer.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MsgUnchoke, msg.Id)
+
+	// pieces we don't have and blocks out of the piece are ignored, the
+	// canceled request is never served
+	_, err = peer.Write(msgBytes(
+		NewRequestMsg(2, 0, 2),
+		NewRequestMsg(1, 2, 4),
+		NewRequestMsg(0, 1, 2),
+		NewRequestMsg(1, 0, 4),
+		NewCancelMsg(1, 0, 4),
+		NewRequestMsg(1, 1, 3),
+	))
+	assert.Equal(t, nil, err)
+	msg, err = peer.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, NewPieceMsg(0, 1, []byte("bc")), msg)
+	msg, err = peer.ReadMsg()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, NewPieceMsg(1, 1, []byte("fgh")), msg)
+
+	peer.Close()
+	<-done
+	assert.Equal(t, int64(5), task.Uploaded())
+}
+
+func TestGetRequest(t *testing.T) {
+	index, offset, length, err := GetRequest(NewRequestMsg(3, 16384, 100))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{3, 16384, 100}, []int{index, offset, length})
+	_, _, _, err = GetRequest(NewHaveMsg(1))
+	assert.NotEqual(t, nil, err)
+	_, _, _, err = GetRequest(&PeerMsg{MsgCancel, []byte{1}})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestJoinConnDuplicate(t *testing.T) {
+	task := newSeedTask([]byte("some data"), 4)
+	dialed := &PeerInfo{Ip: net.ParseIP("10.0.0.1"), Port: 6881}
+	task.PeerMap[dialed.Addr()] = dialed
+	first := &PeerConn{peer: &PeerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 1000}, peerID: [PeerIdLen]byte{2}}
+	assert.Equal(t, true, task.joinConn(first))
+	defer task.wg.Done()
+
+	// a peer we dialed, or one connected twice, is refused
+	assert.Equal(t, false, task.joinConn(&PeerConn{peer: dialed, peerID: [PeerIdLen]byte{1}}))
+	again := &PeerConn{peer: &PeerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 1001}, peerID: first.peerID}
+	assert.Equal(t, false, task.joinConn(again))
+	other := &PeerConn{peer: &PeerInfo{Ip: net.ParseIP("10.0.0.3"), Port: 1000}, peerID: [PeerIdLen]byte{3}}
+	assert.Equal(t, true, task.joinConn(other))
+	defer task.wg.Done()
+	assert.Equal(t, 2, len(task.conns))
+}
@@ -0,0 +1,264 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Storage keeps the verified pieces of a torrent
+type Storage interface {
+	WritePiece(index int, data []byte) error
+	ReadPiece(index int) ([]byte, error)
+	Close() error
+}
+
+// pieceBounds returns the range of piece index in the torrent data
+func pieceBounds(index, pieceLen, fileLen int) (begin, end int, err error) {
+	begin = index * pieceLen
+	if index < 0 || begin >= fileLen {
+		return 0, 0, fmt.Errorf("piece index %d out of range", index)
+	}
+	end = begin + pieceLen
+	if end > fileLen {
+		end = fileLen
+	}
+	return
+}
+
+// fileEntry is one file of a torrent laid out on disk. The data of a torrent
+// is the concatenation of its files, offset is where this file starts in it.
+type fileEntry struct {
+	path   string
+	offset int
+	length int
+}
+
+// layout maps byte ranges of the torrent data onto the files holding them
+type layout []fileEntry
+
+// newLayout places the files of a torrent on disk. A single-file torrent is
+// saved to path itself, a multi-file one is saved under path/FileName/
+// following the `path` list of each file.
+func newLayout(path string, fileName string, fileLen int, fileList []File) (layout, error) {
+	if fileList == nil {
+		return layout{{path: path, length: fileLen}}, nil
+	}
+	dir, err := safePath(fileName)
+	if err != nil {
+		return nil, err
+	}
+	res := make(layout, len(fileList))
+	offset := 0
+	for i, f := range fileList {
+		rel, err := safePath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = fileEntry{
+			path:   filepath.Join(path, dir, rel),
+			offset: offset,
+			length: f.Length,
+		}
+		offset += f.Length
+	}
+	return res, nil
+}
+
+// safePath turns a "/" separated torrent path into a relative local path,
+// rejecting components that could escape the download directory. Names like
+// "Movie: Subtitle" are fine but on Windows, where `\` and `:` are separators
+// or drive letters.
+func safePath(p string) (string, error) {
+	unsafe := "\x00"
+	if runtime.GOOS == "windows" {
+		unsafe += "\\:"
+	}
+	parts := strings.Split(p, "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." ||
+			strings.ContainsAny(part, unsafe) {
+			return "", fmt.Errorf("unsafe path component %q in %q", part, p)
+		}
+	}
+	return filepath.Join(parts...), nil
+}
+
+// spans calls fn for every file overlapping [off, off+n), with the part of
+// the range inside that file: from begin to end in torrent offsets.
+func (l layout) spans(off, n int, fn func(i, begin, end int) error) error {
+	end := off + n
+	for i, f := range l {
+		fEnd := f.offset + f.length
+		if fEnd <= off || f.offset >= end {
+			continue
+		}
+		begin, stop := off, end
+		if begin < f.offset {
+			begin = f.offset
+		}
+		if stop > fEnd {
+			stop = fEnd
+		}
+		if err := fn(i, begin, stop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileStorage writes pieces straight into the files of the torrent
+type FileStorage struct {
+	files    layout
+	handles  []*os.File
+	pieceLen int
+	fileLen  int
+}
+
+// NewFileStorage creates the files of tf under path, see DownloadToFile for
+// where they go, and keeps them open until Close.
+func NewFileStorage(path string, tf *TorrentFile) (*FileStorage, error) {
+	return newFileStorage(path, tf, true)
+}
+
+// OpenFileStorage opens the files of tf under path read-only, leaving them
+// untouched. Pieces in files that are missing or too short can't be read.
+func OpenFileStorage(path string, tf *TorrentFile) (*FileStorage, error) {
+	return newFileStorage(path, tf, false)
+}
+
+func newFileStorage(path string, tf *TorrentFile, create bool) (*FileStorage, error) {
+	files, err := newLayout(path, tf.FileName, tf.FileLen, tf.FileList)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStorage{
+		files:    files,
+		handles:  make([]*os.File, 0, len(files)),
+		pieceLen: tf.PieceLen,
+		fileLen:  tf.FileLen,
+	}
+	for _, f := range files {
+		if !create {
+			// a missing file is left nil
+			file, _ := os.Open(f.path)
+			s.handles = append(s.handles, file)
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(f.path), 0755)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles = append(s.handles, file)
+		// size the file up front, keeping whatever it already holds
+		err = file.Truncate(int64(f.length))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *FileStorage) WritePiece(index int, data []byte) error {
+	begin, end, err := pieceBounds(index, s.pieceLen, s.fileLen)
+	if err != nil {
+		return err
+	}
+	if len(data) != end-begin {
+		return fmt.Errorf("piece %d has length %d, expect %d", index, len(data), end-begin)
+	}
+	return s.files.spans(begin, len(data), func(i, b, e int) error {
+		if s.handles[i] == nil {
+			return fmt.Errorf("missing file " + s.files[i].path)
+		}
+		_, err := s.handles[i].WriteAt(data[b-begin:e-begin], int64(b-s.files[i].offset))
+		return err
+	})
+}
+
+func (s *FileStorage) ReadPiece(index int) ([]byte, error) {
+	begin, end, err := pieceBounds(index, s.pieceLen, s.fileLen)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, end-begin)
+	err = s.files.spans(begin, len(data), func(i, b, e int) error {
+		if s.handles[i] == nil {
+			return fmt.Errorf("missing file " + s.files[i].path)
+		}
+		_, err := s.handles[i].ReadAt(data[b-begin:e-begin], int64(b-s.files[i].offset))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close closes every file, returning the first error met
+func (s *FileStorage) Close() error {
+	var res error
+	for _, file := range s.handles {
+		if file == nil {
+			continue
+		}
+		if err := file.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	s.handles = nil
+	return res
+}
+
+// MemStorage keeps the whole torrent in memory, mostly useful for tests
+type MemStorage struct {
+	buf      []byte
+	pieceLen int
+}
+
+func NewMemStorage(tf *TorrentFile) *MemStorage {
+	return &MemStorage{
+		buf:      make([]byte, tf.FileLen),
+		pieceLen: tf.PieceLen,
+	}
+}
+
+func (s *MemStorage) WritePiece(index int, data []byte) error {
+	begin, end, err := pieceBounds(index, s.pieceLen, len(s.buf))
+	if err != nil {
+		return err
+	}
+	if len(data) != end-begin {
+		return fmt.Errorf("piece %d has length %d, expect %d", index, len(data), end-begin)
+	}
+	copy(s.buf[begin:end], data)
+	return nil
+}
+
+func (s *MemStorage) ReadPiece(index int) ([]byte, error) {
+	begin, end, err := pieceBounds(index, s.pieceLen, len(s.buf))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, end-begin)
+	copy(data, s.buf[begin:end])
+	return data, nil
+}
+
+func (s *MemStorage) Close() error {
+	return nil
+}
+
+// Bytes returns the whole torrent data
+func (s *MemStorage) Bytes() []byte {
+	return s.buf
+}
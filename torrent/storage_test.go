@@ -0,0 +1,121 @@
+package torrent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFileStorageMultiFile(t *testing.T) {
+	dir := t.TempDir()
+	tf := &TorrentFile{
+		FileName: "name",
+		FileLen:  9,
+		PieceLen: 5,
+		FileList: []File{
+			{Length: 3, Path: "a.txt"},
+			{Length: 0, Path: "empty"},
+			{Length: 4, Path: "sub/dir/b.txt"},
+			{Length: 2, Path: "c.txt"},
+		},
+	}
+	s, err := NewFileStorage(dir, tf)
+	assert.Equal(t, nil, err)
+
+	// piece 0 spans a.txt, empty and b.txt, the last piece is short
+	assert.Equal(t, nil, s.WritePiece(1, []byte("fghi")))
+	assert.Equal(t, nil, s.WritePiece(0, []byte("abcde")))
+	assert.NotEqual(t, nil, s.WritePiece(1, []byte("fgh")))
+	assert.NotEqual(t, nil, s.WritePiece(2, []byte("x")))
+	data, err := s.ReadPiece(0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abcde", string(data))
+	assert.Equal(t, nil, s.Close())
+
+	expect := map[string]string{
+		"a.txt":         "abc",
+		"empty":         "",
+		"sub/dir/b.txt": "defg",
+		"c.txt":         "hi",
+	}
+	for path, content := range expect {
+		data, err := os.ReadFile(filepath.Join(dir, "name", path))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, content, string(data), path)
+	}
+
+	// reopening keeps what is already on disk
+	s, err = NewFileStorage(dir, tf)
+	assert.Equal(t, nil, err)
+	defer s.Close()
+	data, _ = s.ReadPiece(1)
+	assert.Equal(t, "fghi", string(data))
+}
+
+func TestFileStorageSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.iso")
+	tf := &TorrentFile{FileName: "debian.iso", FileLen: 4, PieceLen: 2}
+	s, err := NewFileStorage(path, tf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, s.WritePiece(1, []byte("cd")))
+	assert.Equal(t, nil, s.Close())
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "\x00\x00cd", string(data))
+}
+
+func TestMemStorage(t *testing.T) {
+	s := NewMemStorage(&TorrentFile{FileLen: 5, PieceLen: 2})
+	assert.Equal(t, nil, s.WritePiece(2, []byte("e")))
+	assert.Equal(t, nil, s.WritePiece(0, []byte("ab")))
+	assert.NotEqual(t, nil, s.WritePiece(3, []byte("f")))
+	data, err := s.ReadPiece(2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "e", string(data))
+	_, err = s.ReadPiece(-1)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "ab\x00\x00e", string(s.Bytes()))
+}
+
+func TestLayoutUnsafePath(t *testing.T) {
+	unsafe := []string{"../evil", "a/../../evil", "a//b", "./a", "a\x00b", ""}
+	if runtime.GOOS == "windows" {
+		unsafe = append(unsafe, "a\\..\\b", "C:evil")
+	}
+	for _, p := range unsafe {
+		_, err := newLayout("dl", "name", 1, []File{{Length: 1, Path: p}})
+		assert.NotEqual(t, nil, err, p)
+	}
+	_, err := newLayout("dl", "..", 1, []File{{Length: 1, Path: "a"}})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestLayoutColonName(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colons are not allowed in Windows file names")
+	}
+	dir := t.TempDir()
+	tf := &TorrentFile{
+		FileName: "Movie: Subtitle",
+		FileLen:  3,
+		PieceLen: 4,
+		FileList: []File{{Length: 3, Path: "Part 1: Intro.mkv"}},
+	}
+	s, err := NewFileStorage(dir, tf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, s.WritePiece(0, []byte("abc")))
+	assert.Equal(t, nil, s.Close())
+	data, _ := os.ReadFile(filepath.Join(dir, "Movie: Subtitle", "Part 1: Intro.mkv"))
+	assert.Equal(t, "abc", string(data))
+}
+
+func TestLayoutTestfile(t *testing.T) {
+	tf, err := Open("../testfile/cyberpunk.torrent")
+	assert.Equal(t, nil, err)
+	files, err := newLayout("dl", tf.FileName, tf.FileLen, tf.FileList)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(tf.FileList), len(files))
+	last := files[len(files)-1]
+	assert.Equal(t, tf.FileLen, last.offset+last.length)
+}
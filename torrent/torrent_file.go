@@ -9,52 +9,87 @@ import (
 	"github.com/berylyvos/gorrent/bencode"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type file struct {
-	Length int      `bencode:"length"`
-	Path   []string `bencode:"path"`
+	Length int      `bencode:"length,required"`
+	Path   []string `bencode:"path,required"`
 }
 
-type rawInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+// pieceHashes is the `pieces` blob of the info dict, which is the concatenation
+// of each piece's SHA-1 hash
+type pieceHashes [][ShaLen]byte
+
+func (ph pieceHashes) MarshalBencode() ([]byte, error) {
+	buf := make([]byte, 0, len(ph)*ShaLen)
+	for _, sha := range ph {
+		buf = append(buf, sha[:]...)
+	}
+	w := new(bytes.Buffer)
+	bencode.EncodeString(w, string(buf))
+	return w.Bytes(), nil
 }
 
-type rawInfoMulti struct {
-	Files       []file `bencode:"files"`
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+// UnmarshalBencode splits the blob into pieces
+func (ph *pieceHashes) UnmarshalBencode(data []byte) error {
+	piecesBytes, err := bencode.DecodeString(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if len(piecesBytes)%ShaLen != 0 {
+		return fmt.Errorf("malformed pieces of length %d", len(piecesBytes))
+	}
+	piecesCnt := len(piecesBytes) / ShaLen
+	*ph = make(pieceHashes, piecesCnt)
+	for i := 0; i < piecesCnt; i++ {
+		copy((*ph)[i][:], piecesBytes[i*ShaLen:(i+1)*ShaLen])
+	}
+	return nil
+}
+
+// rawInfo holds either `length` (single file) or `files` (multiple files)
+type rawInfo struct {
+	Files       []file      `bencode:"files,omitempty"`
+	Length      int         `bencode:"length,omitempty"`
+	Name        string      `bencode:"name,required"`
+	PieceLength int         `bencode:"piece length,required"`
+	Pieces      pieceHashes `bencode:"pieces,required"`
 }
 
 type rawFile struct {
-	Announce     string       `bencode:"announce"`
-	AnnounceList [][]string   `bencode:"announce-list"`
-	Info         rawInfo      `bencode:"info"`
-	InfoMulti    rawInfoMulti `bencode:"info"`
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	Info         bencode.RawMessage `bencode:"info,required"`
 }
 
 const ShaLen int = 20
 
+// torrentDecodeOptions bounds what we accept from a .torrent file
+var torrentDecodeOptions = bencode.DecodeOptions{
+	MaxStringLen: 64 << 20,
+	MaxDepth:     16,
+	MaxSize:      64 << 20,
+}
+
 type File struct {
 	Length int
 	Path   string
 }
 
 type TorrentFile struct {
-	Announce     string
-	AnnounceList []string
-	InfoSHA      [ShaLen]byte
-	FileList     []File
-	FileName     string
-	FileLen      int
-	PieceLen     int
-	PieceSHA     [][ShaLen]byte
-	HasMulti     bool
+	Announce      string
+	AnnounceList  []string   // every tracker of AnnounceTiers, flattened
+	AnnounceTiers [][]string // the announce-list, tier by tier
+	InfoSHA       [ShaLen]byte
+	FileList      []File
+	FileName      string
+	FileLen       int
+	PieceLen      int
+	PieceSHA      [][ShaLen]byte
+	HasMulti      bool
 }
 
 func Open(path string) (*TorrentFile, error) {
@@ -73,66 +108,160 @@ func Open(path string) (*TorrentFile, error) {
 
 func ParseFile(r io.Reader) (*TorrentFile, error) {
 	raw := new(rawFile)
-	err := bencode.Unmarshal(r, raw)
+	dec := bencode.NewDecoder(r)
+	dec.SetOptions(torrentDecodeOptions)
+	err := dec.Decode(raw)
 	if err != nil {
 		fmt.Println("failed to parse torrent file")
 		return nil, err
 	}
+	// info dict is kept as raw bytes for hashing, decode it separately
+	info := new(rawInfo)
+	err = bencode.Unmarshal(bytes.NewReader(raw.Info), info)
+	if err != nil {
+		fmt.Println("failed to parse torrent info")
+		return nil, err
+	}
 
-	tf := newTorrentFile(raw)
+	tf := newTorrentFile(raw, info)
 	tf.setInfoSha(raw)
-	tf.setPieceSha(raw)
+	tf.setPieceSha(info)
 	tf.setFileLen()
+	err = tf.check()
+	if err != nil {
+		fmt.Println("invalid torrent info")
+		return nil, err
+	}
 
 	return tf, nil
 }
 
-func (tf *TorrentFile) BuildTorrentTask() (*TorrentTask, error) {
-	// generate random peerId
-	var peerId [PeerIdLen]byte
-	_, _ = rand.Read(peerId[:])
-
+// BuildTorrentTask gets the peers of tf from its trackers, telling them we
+// accept peers on port
+func (tf *TorrentFile) BuildTorrentTask(port int) (*TorrentTask, error) {
+	task := tf.newTorrentTask(port)
 	// retrieve peers from tracker
-	peerMap := make(map[string]*PeerInfo)
-	RetrievePeers(tf, peerId, &peerMap)
-	if len(peerMap) == 0 {
+	RetrievePeers(tf, task.PeerId, port, &task.PeerMap)
+	if len(task.PeerMap) == 0 {
 		return nil, fmt.Errorf("there is no peers")
 	}
-	fmt.Printf("we got %d peers in total\n", len(peerMap))
+	fmt.Printf("we got %d peers in total\n", len(task.PeerMap))
+	return task, nil
+}
+
+// newTorrentTask returns a task for tf with no peer yet
+func (tf *TorrentFile) newTorrentTask(port int) *TorrentTask {
+	// generate random peerId
+	var peerId [PeerIdLen]byte
+	_, _ = rand.Read(peerId[:])
 
 	return &TorrentTask{
 		PeerId:   peerId,
-		PeerMap:  peerMap,
+		PeerMap:  make(map[string]*PeerInfo),
 		InfoSHA:  tf.InfoSHA,
 		FileName: tf.FileName,
 		FileLen:  tf.FileLen,
+		FileList: tf.FileList,
 		PieceLen: tf.PieceLen,
 		PieceSHA: tf.PieceSHA,
-	}, nil
+		Port:     port,
+	}
+}
+
+// DownloadOptions tunes DownloadToFileWith
+type DownloadOptions struct {
+	NoResume bool // neither read nor write the resume record
+	Recheck  bool // hash the data on disk with Verify instead of trusting the resume record
+	// how long to keep uploading to peers once the download is complete
+	SeedTime time.Duration
+	// give up once no piece arrived for that long, DefaultStallTimeout if zero
+	StallTimeout time.Duration
+	// tunes which peers we upload to
+	Choke ChokeConfig
+	// accepts the peers connecting to us, possibly shared by several
+	// downloads. A listener on PeerPort is opened if nil.
+	Listener *Listener
 }
 
+// DownloadToFile saves a single-file torrent to path, and the files of a
+// multi-file torrent under the directory path/FileName/. Pieces are written
+// out as they arrive, and a resume record next to them lets an interrupted
+// download pick up where it stopped. The trackers are announced to all along,
+// see Announcer.
 func (tf *TorrentFile) DownloadToFile(path string) error {
-	// build torrent task
-	task, err := tf.BuildTorrentTask()
+	return tf.DownloadToFileWith(path, DownloadOptions{})
+}
+
+func (tf *TorrentFile) DownloadToFileWith(path string, opts DownloadOptions) error {
+	files, err := newLayout(path, tf.FileName, tf.FileLen, tf.FileList)
 	if err != nil {
-		return fmt.Errorf("build torrent task error: %v", err.Error())
+		return fmt.Errorf("fail to create files of %v: %v", tf.FileName, err.Error())
+	}
+	// find what is saved already, before the storage resizes the files
+	done := NewBitfield(len(tf.PieceSHA))
+	if opts.Recheck {
+		res, err := tf.Verify(path)
+		if err != nil {
+			return fmt.Errorf("fail to verify %v: %v", tf.FileName, err.Error())
+		}
+		done = res.Bitfield
+		fmt.Printf("found %d of %d pieces on disk\n", done.Count(), len(tf.PieceSHA))
+	} else if !opts.NoResume {
+		done = loadResume(resumePath(path, tf), tf, files)
+	}
+
+	ln := opts.Listener
+	if ln == nil {
+		ln, err = listenPeerPort()
+		if err != nil {
+			return fmt.Errorf("fail to listen for peers: %v", err.Error())
+		}
+		defer ln.Close()
+	}
+
+	// build torrent task, the announcer gives it peers
+	task := tf.newTorrentTask(ln.Port())
+	storage, err := NewFileStorage(path, tf)
+	if err != nil {
+		return fmt.Errorf("fail to create files of %v: %v", tf.FileName, err.Error())
+	}
+	defer storage.Close()
+	task.Storage = storage
+	task.Choke = opts.Choke
+	task.StallTimeout = opts.StallTimeout
+	task.Bitfield = done
+	if !opts.NoResume {
+		task.ResumePath = resumePath(path, tf)
 	}
 
 	// download from peers
-	buf, err := task.Download()
+	ln.Add(task)
+	defer ln.Remove(task)
+	defer task.Stop()
+	an := NewAnnouncer(tf, task)
+	an.Start()
+	defer an.Stop()
+	err = task.Download()
 	if err != nil {
 		return fmt.Errorf("download error: %v", err.Error())
 	}
-	// save data to file
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("fail to create file: " + task.FileName)
+	if opts.SeedTime > 0 {
+		fmt.Printf("seeding %s for %v\n", tf.FileName, opts.SeedTime)
+		time.Sleep(opts.SeedTime)
 	}
-	_, err = file.Write(buf)
-	if err != nil {
-		return fmt.Errorf("fail to save data to file: %v", err.Error())
+	task.Stop()
+	an.Stop()
+	return storage.Close()
+}
+
+// listenPeerPort listens on PeerPort, or any free port if it's taken
+func listenPeerPort() (*Listener, error) {
+	ln, err := Listen(":" + strconv.Itoa(PeerPort))
+	if err == nil {
+		return ln, nil
 	}
-	return nil
+	fmt.Printf("port %d unavailable: %v\n", PeerPort, err)
+	return Listen(":0")
 }
 
 func flattenFiles(files []file) []File {
@@ -163,47 +292,68 @@ func flattenAnnounceList(list [][]string) []string {
 	return res
 }
 
-func newTorrentFile(raw *rawFile) *TorrentFile {
+// announceTiers returns the tiers of trackers to announce to: the
+// announce-list if any, since BEP-12 says to ignore `announce` then
+func (tf *TorrentFile) announceTiers() [][]string {
+	if len(tf.AnnounceTiers) > 0 {
+		return tf.AnnounceTiers
+	}
+	if len(tf.AnnounceList) > 0 {
+		return [][]string{tf.AnnounceList}
+	}
+	if tf.Announce != "" {
+		return [][]string{{tf.Announce}}
+	}
+	return nil
+}
+
+func newTorrentFile(raw *rawFile, info *rawInfo) *TorrentFile {
 	tf := new(TorrentFile)
 	tf.Announce = raw.Announce
 	tf.AnnounceList = flattenAnnounceList(raw.AnnounceList)
-	tf.FileList = flattenFiles(raw.InfoMulti.Files)
+	tf.AnnounceTiers = raw.AnnounceList
+	tf.FileList = flattenFiles(info.Files)
 	if tf.FileList != nil {
 		tf.HasMulti = true
 	}
-	tf.FileName = raw.Info.Name
-	tf.FileLen = raw.Info.Length
-	tf.PieceLen = raw.Info.PieceLength
+	tf.FileName = info.Name
+	tf.FileLen = info.Length
+	tf.PieceLen = info.PieceLength
 	return tf
 }
 
 // setInfoSha compute InfoSHA which is the SHA-1 hash of the entire bencoded info dict
-// Be careful! If there's only a single file, bencoded data should not contain `files`.
+// The hash is taken over the original bytes of the info dict, since re-encoding it
+// would drop any key we don't know about (e.g. `private`, `source`).
 func (tf *TorrentFile) setInfoSha(raw *rawFile) {
-	buf := new(bytes.Buffer)
-	wLen := 0
-	if tf.HasMulti {
-		wLen = bencode.Marshal(buf, raw.InfoMulti)
-	} else {
-		wLen = bencode.Marshal(buf, raw.Info)
-	}
-	if wLen == 0 {
-		fmt.Println("raw file info marshal error")
-	}
-	tf.InfoSHA = sha1.Sum(buf.Bytes())
+	tf.InfoSHA = sha1.Sum(raw.Info)
 }
 
-// setPieceSha compute PieceSHA which is a slice of each piece's SHA-1
-// raw.Info.Pieces is a big binary blob containing the SHA-1 hashes of
-// each piece, now we want to split it into pieces.
-func (tf *TorrentFile) setPieceSha(raw *rawFile) {
-	piecesBytes := []byte(raw.Info.Pieces)
-	piecesCnt := len(piecesBytes) / ShaLen
-	pieceSHA := make([][ShaLen]byte, piecesCnt)
-	for i := 0; i < piecesCnt; i++ {
-		copy(pieceSHA[i][:], piecesBytes[i*ShaLen:(i+1)*ShaLen])
+// setPieceSha set PieceSHA which is a slice of each piece's SHA-1,
+// already split from the `pieces` blob by pieceHashes.
+func (tf *TorrentFile) setPieceSha(info *rawInfo) {
+	tf.PieceSHA = info.Pieces
+}
+
+// check rejects a torrent that parses but can't be downloaded, e.g. one whose
+// pieces don't cover its files exactly
+func (tf *TorrentFile) check() error {
+	if tf.PieceLen <= 0 {
+		return fmt.Errorf("invalid piece length %d", tf.PieceLen)
+	}
+	if tf.FileLen < 0 {
+		return fmt.Errorf("invalid length %d", tf.FileLen)
+	}
+	for _, f := range tf.FileList {
+		if f.Length < 0 {
+			return fmt.Errorf("invalid length %d of file %v", f.Length, f.Path)
+		}
 	}
-	tf.PieceSHA = pieceSHA
+	pieceCount := (tf.FileLen + tf.PieceLen - 1) / tf.PieceLen
+	if len(tf.PieceSHA) != pieceCount {
+		return fmt.Errorf("%d piece hashes for %d pieces", len(tf.PieceSHA), pieceCount)
+	}
+	return nil
 }
 
 // setFileLen set total length of tf.FileList to tf.FileLen if tf.FileLen == 0
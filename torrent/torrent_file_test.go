@@ -1,8 +1,12 @@
 package torrent
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"fmt"
+	"github.com/berylyvos/gorrent/bencode"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -23,3 +27,77 @@ func TestParseMultiFile(t *testing.T) {
 	tf, err := Open("../testfile/cyberpunk.torrent")
 	fmt.Printf("%+v\n%v\n", tf, err)
 }
+
+func TestParseFileExtraInfoKeys(t *testing.T) {
+	pieces := strings.Repeat("x", 2*ShaLen)
+	info := "d6:lengthi1024e3:md5" + "32:" + strings.Repeat("0", 32) +
+		"4:name8:test.bin12:piece lengthi512e6:pieces40:" + pieces +
+		"7:privatei1e6:source3:ABCe"
+	in := "d8:announce31:http://tracker.example/announce4:info" + info + "e"
+
+	tf, err := ParseFile(strings.NewReader(in))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "test.bin", tf.FileName)
+	assert.Equal(t, 1024, tf.FileLen)
+	assert.Equal(t, 2, len(tf.PieceSHA))
+	assert.Equal(t, sha1.Sum([]byte(info)), tf.InfoSHA)
+}
+
+func TestParseFileLimits(t *testing.T) {
+	_, err := ParseFile(strings.NewReader("d8:announce99999999999999999999:x"))
+	assert.ErrorIs(t, err, bencode.ErrOvf)
+	_, err = ParseFile(strings.NewReader("d8:announce99999999999:x"))
+	assert.ErrorIs(t, err, bencode.ErrLen)
+	_, err = ParseFile(strings.NewReader("d4:info" + strings.Repeat("l", 20)))
+	assert.ErrorIs(t, err, bencode.ErrDep)
+}
+
+func TestPieceHashes(t *testing.T) {
+	blob := strings.Repeat("a", ShaLen) + strings.Repeat("b", ShaLen)
+	var ph pieceHashes
+	err := bencode.Unmarshal(strings.NewReader("40:"+blob), &ph)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(ph))
+	assert.Equal(t, byte('b'), ph[1][0])
+
+	buf := new(bytes.Buffer)
+	assert.Equal(t, nil, bencode.NewEncoder(buf).Encode(ph))
+	assert.Equal(t, "40:"+blob, buf.String())
+
+	err = bencode.Unmarshal(strings.NewReader("3:abc"), &ph)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseAnnounceTiers(t *testing.T) {
+	info := "d6:lengthi1024e4:name8:test.bin12:piece lengthi512e6:pieces40:" + strings.Repeat("x", 2*ShaLen) + "e"
+	in := "d8:announce5:http:13:announce-listll5:udp:15:udp:2el5:http:ee4:info" + info + "e"
+
+	tf, err := ParseFile(strings.NewReader(in))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]string{{"udp:1", "udp:2"}, {"http:"}}, tf.AnnounceTiers)
+	assert.Equal(t, []string{"udp:1", "udp:2", "http:"}, tf.AnnounceList)
+	// the announce-list takes over announce
+	assert.Equal(t, tf.AnnounceTiers, tf.announceTiers())
+	tf.AnnounceTiers, tf.AnnounceList = nil, nil
+	assert.Equal(t, [][]string{{"http:"}}, tf.announceTiers())
+}
+
+func TestParseFileInvalidInfo(t *testing.T) {
+	parse := func(info string) error {
+		_, err := ParseFile(strings.NewReader("d4:info" + info + "e"))
+		return err
+	}
+	hashes := func(n int) string {
+		return fmt.Sprintf("6:pieces%d:%s", n*ShaLen, strings.Repeat("x", n*ShaLen))
+	}
+	assert.Equal(t, nil, parse("d6:lengthi1025e4:name1:a12:piece lengthi512e"+hashes(3)+"e"))
+	// a zero piece length
+	assert.NotEqual(t, nil, parse("d6:lengthi1024e4:name1:a12:piece lengthi0e"+hashes(2)+"e"))
+	// negative lengths
+	assert.NotEqual(t, nil, parse("d6:lengthi-1024e4:name1:a12:piece lengthi512e"+hashes(0)+"e"))
+	assert.NotEqual(t, nil, parse("d5:filesld6:lengthi1024e4:pathl1:aeed6:lengthi-512e4:pathl1:beee"+
+		"4:name1:a12:piece lengthi512e"+hashes(1)+"e"))
+	// too many or too few hashes
+	assert.NotEqual(t, nil, parse("d6:lengthi1024e4:name1:a12:piece lengthi512e"+hashes(3)+"e"))
+	assert.NotEqual(t, nil, parse("d6:lengthi1025e4:name1:a12:piece lengthi512e"+hashes(2)+"e"))
+}
@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -18,13 +19,22 @@ const (
 	PeerIdLen            int = 20
 	PeerPort             int = 7777
 	IPLen                int = 4
+	IPv6Len              int = 16
 	PortLen              int = 2
 	PeerLen                  = IPLen + PortLen
+	Peer6Len                 = IPv6Len + PortLen
 	RetrievePeersTimeout int = 5
 )
 
 const UDPTrackerProtocolID = 0x41727101980
 
+// trackerDecodeOptions bounds what we accept from a tracker response
+var trackerDecodeOptions = bencode.DecodeOptions{
+	MaxStringLen: 1 << 20,
+	MaxDepth:     8,
+	MaxSize:      2 << 20,
+}
+
 // UDP Tracker protocol action type
 const (
 	ActionConnect = iota
@@ -38,9 +48,70 @@ type PeerInfo struct {
 	Port uint16
 }
 
+// Addr returns the host:port of the peer, the IP bracketed if it's IPv6.
+// Peers are told apart by it, several may share an IP.
+func (p *PeerInfo) Addr() string {
+	return net.JoinHostPort(p.Ip.String(), strconv.Itoa(int(p.Port)))
+}
+
 type HTTPTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string       `bencode:"failure reason,omitempty"`
+	WarningMessage string       `bencode:"warning message,omitempty"`
+	Interval       int          `bencode:"interval"`
+	MinInterval    int          `bencode:"min interval,omitempty"`
+	TrackerId      string       `bencode:"tracker id,omitempty"`
+	Complete       int          `bencode:"complete"`
+	Incomplete     int          `bencode:"incomplete"`
+	Peers          trackerPeers `bencode:"peers"`
+	Peers6         string       `bencode:"peers6,omitempty"`
+}
+
+// TrackerFailure is the reason a tracker gave for refusing a request
+type TrackerFailure struct {
+	Reason string
+}
+
+func (e *TrackerFailure) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+// trackerPeers are the peers of an HTTP tracker response, either in the
+// compact model, a string of 6 bytes per peer, or in the dictionary model, a
+// list of dicts with the ip and port of each peer. The IPv6 peers are in
+// peers6, compact only, 18 bytes each (BEP-7).
+type trackerPeers []*PeerInfo
+
+func (tp *trackerPeers) UnmarshalBencode(data []byte) error {
+	if len(data) == 0 || data[0] != 'l' {
+		var compact string
+		err := bencode.Unmarshal(bytes.NewReader(data), &compact)
+		if err != nil {
+			return err
+		}
+		*tp = buildPeerInfo([]byte(compact), IPLen)
+		return nil
+	}
+	var peers []struct {
+		Ip   string `bencode:"ip"`
+		Port int    `bencode:"port"`
+	}
+	err := bencode.Unmarshal(bytes.NewReader(data), &peers)
+	if err != nil {
+		return err
+	}
+	*tp = nil
+	for _, p := range peers {
+		// peers may be given by DNS name, which we don't resolve
+		ip := net.ParseIP(p.Ip)
+		if ip == nil || p.Port <= 0 || p.Port > 0xffff {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		*tp = append(*tp, &PeerInfo{Ip: ip, Port: uint16(p.Port)})
+	}
+	return nil
 }
 
 type UDPTracker struct {
@@ -49,196 +120,270 @@ type UDPTracker struct {
 	Port int
 }
 
-func buildHTTPTrackerUrls(tf *TorrentFile, peerId [PeerIdLen]byte) ([]string, error) {
-	var urls []string
-	if len(tf.Announce) != 0 && isHTTPTrackerUrl(tf.Announce) {
-		urls = append(urls, tf.Announce)
+// AnnounceEvent tells a tracker why we announce, the values are the ones of
+// the UDP protocol
+type AnnounceEvent uint32
+
+const (
+	EventNone AnnounceEvent = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+// String returns the event as the HTTP protocol names it
+func (e AnnounceEvent) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
 	}
-	if len(tf.AnnounceList) != 0 {
-		for _, an := range tf.AnnounceList {
-			if isHTTPTrackerUrl(an) {
-				urls = append(urls, an)
-			}
-		}
+	return ""
+}
+
+// announceParams is what we tell a tracker when announcing
+type announceParams struct {
+	infoSHA    [ShaLen]byte
+	peerId     [PeerIdLen]byte
+	port       int // TCP port we accept peers on
+	uploaded   int64
+	downloaded int64
+	left       int64
+	event      AnnounceEvent
+	trackerId  string // what the tracker asked us to send back, if anything
+}
+
+// announceResult is what a tracker answers to an announce
+type announceResult struct {
+	Interval    time.Duration // how long to wait before announcing again
+	MinInterval time.Duration // never announce again sooner, if not zero
+	Warning     string
+	TrackerId   string // to send back in the next announces
+	Seeders     int
+	Leechers    int
+	Peers       []*PeerInfo
+}
+
+// tracker is a tracker we can announce to
+type tracker interface {
+	announce(p announceParams) (*announceResult, error)
+	scrape(infoHashes [][ShaLen]byte) (map[[ShaLen]byte]ScrapeResult, error)
+	String() string
+}
+
+// httpTracker is the announce url of an HTTP tracker
+type httpTracker string
+
+// announceUrl adds the parameters of an announce to the url of an HTTP tracker
+func announceUrl(u string, p announceParams) (string, error) {
+	baseUrl, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"info_hash":  []string{string(p.infoSHA[:])},
+		"peer_id":    []string{string(p.peerId[:])},
+		"port":       []string{strconv.Itoa(p.port)},
+		"uploaded":   []string{strconv.FormatInt(p.uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(p.downloaded, 10)},
+		"compact":    []string{"1"},
+		"left":       []string{strconv.FormatInt(p.left, 10)},
 	}
-	if len(urls) == 0 {
-		return nil, errors.New("got no http announce url")
+	if p.event != EventNone {
+		params.Set("event", p.event.String())
 	}
+	if p.trackerId != "" {
+		params.Set("trackerid", p.trackerId)
+	}
+	baseUrl.RawQuery = params.Encode()
+	return baseUrl.String(), nil
+}
 
-	var res []string
-	for _, u := range urls {
-		baseUrl, err := url.Parse(u)
+// newTracker returns the tracker announced to at url u
+func newTracker(u string) (tracker, error) {
+	switch {
+	case isHTTPTrackerUrl(u):
+		if _, err := url.Parse(u); err != nil {
+			return nil, err
+		}
+		return httpTracker(u), nil
+	case isUDPTrackerUrl(u):
+		parsed, err := url.Parse(u)
 		if err != nil {
-			fmt.Println("http announce url parse error: " + u)
-			continue
+			return nil, err
 		}
-		params := url.Values{
-			"info_hash":  []string{string(tf.InfoSHA[:])},
-			"peer_id":    []string{string(peerId[:])},
-			"port":       []string{strconv.Itoa(PeerPort)},
-			"uploaded":   []string{"0"},
-			"downloaded": []string{"0"},
-			"compact":    []string{"1"},
-			"left":       []string{strconv.Itoa(tf.FileLen)},
+		port, err := strconv.Atoi(parsed.Port())
+		if err != nil {
+			return nil, fmt.Errorf("bad port in %v", u)
 		}
-		baseUrl.RawQuery = params.Encode()
-		res = append(res, baseUrl.String())
+		return UDPTracker{Host: parsed.Hostname(), Port: port}, nil
 	}
-	return res, nil
+	return nil, fmt.Errorf("unsupported tracker %v", u)
 }
 
-func buildUDPTrackers(tf *TorrentFile) ([]UDPTracker, error) {
-	var trackers []UDPTracker
-	for _, ann := range tf.AnnounceList {
-		if !isUDPTrackerUrl(ann) {
-			continue
-		}
-		tr := UDPTracker{}
-		urlStr := strings.Split(strings.Split(ann, "/")[2], ":")
-		tr.Host = urlStr[0]
-		tr.Port, _ = strconv.Atoi(urlStr[1])
-		ips, err := net.LookupIP(urlStr[0])
-		if err != nil {
-			fmt.Printf("%v host look up ip error: %v\n", tr.Host, err)
+// buildPeerInfo parses peers in the compact format, an IP of ipLen bytes,
+// IPLen or IPv6Len, then a port each
+func buildPeerInfo(peers []byte, ipLen int) []*PeerInfo {
+	peerLen := ipLen + PortLen
+	if len(peers)%peerLen != 0 {
+		fmt.Println("received malformed peers")
+	}
+	num := len(peers) / peerLen
+	var res []*PeerInfo
+	for i := 0; i < num; i++ {
+		offset := i * peerLen
+		port := binary.BigEndian.Uint16(peers[offset+ipLen : offset+peerLen])
+		if port == 0 {
 			continue
 		}
-		tr.IP = ips[0]
-		trackers = append(trackers, tr)
+		res = append(res, &PeerInfo{
+			Ip:   net.IP(append([]byte(nil), peers[offset:offset+ipLen]...)),
+			Port: port,
+		})
 	}
-	return trackers, nil
+	return res
 }
 
-func buildPeerInfo(peers []byte, peerChan chan *PeerInfo) {
-	if len(peers)%PeerLen != 0 {
-		fmt.Println("received malformed peers")
+// RetrievePeers announces to the trackers of tf once, that we accept peers on
+// port. The trackers are tried in the order of BEP-12 until one answers.
+func RetrievePeers(tf *TorrentFile, peerId [PeerIdLen]byte, port int, peerMap *map[string]*PeerInfo) {
+	task := tf.newTorrentTask(port)
+	task.PeerId = peerId
+	res, err := NewAnnouncer(tf, task).announce(EventNone)
+	if err != nil {
+		fmt.Println("retrieve peers error: " + err.Error())
+		return
 	}
-	num := len(peers) / PeerLen
-	for i := 0; i < num; i++ {
-		offset := i * PeerLen
-		peerChan <- &PeerInfo{
-			Ip:   peers[offset : offset+IPLen],
-			Port: binary.BigEndian.Uint16(peers[offset+IPLen : offset+PeerLen]),
+	for _, p := range res.Peers {
+		if _, ok := (*peerMap)[p.Addr()]; !ok {
+			(*peerMap)[p.Addr()] = p
+			fmt.Printf("peer [%s]\n", p.Addr())
 		}
 	}
 }
 
-func RetrievePeers(tf *TorrentFile, peerId [PeerIdLen]byte, peerMap *map[string]*PeerInfo) {
-	httpTrackerUrls, err := buildHTTPTrackerUrls(tf, peerId)
+func (tr httpTracker) String() string {
+	return string(tr)
+}
+
+func (tr httpTracker) announce(p announceParams) (*announceResult, error) {
+	trackerUrl, err := announceUrl(string(tr), p)
 	if err != nil {
-		fmt.Println("build http tracker urls error: " + err.Error())
+		return nil, err
 	}
-	udpTrackers, err := buildUDPTrackers(tf)
+	cli := &http.Client{Timeout: time.Duration(RetrievePeersTimeout) * time.Second}
+	resp, err := cli.Get(trackerUrl)
 	if err != nil {
-		fmt.Println("build udp tracker urls error: " + err.Error())
+		return nil, fmt.Errorf("failed to connect to tracker: %v", err)
 	}
 
-	peerChan := make(chan *PeerInfo)
-	getPeersFromHTTPTrackers(httpTrackerUrls, peerChan)
-	getPeersFromUDPTrackers(tf, udpTrackers, peerId, peerChan)
-
-	for {
-		select {
-		case p := <-peerChan:
-			if _, ok := (*peerMap)[p.Ip.String()]; !ok {
-				(*peerMap)[p.Ip.String()] = p
-				fmt.Printf("peer [ip: %s, port: %d]\n", p.Ip, p.Port)
-			}
-		case <-time.After(time.Duration(RetrievePeersTimeout) * time.Second):
-			close(peerChan)
-			return
-		}
+	trackerResp := new(HTTPTrackerResp)
+	dec := bencode.NewDecoder(resp.Body)
+	dec.SetOptions(trackerDecodeOptions)
+	err = dec.Decode(trackerResp)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("tracker response error: %v", err)
+	}
+	if trackerResp.FailureReason != "" {
+		return nil, &TrackerFailure{Reason: trackerResp.FailureReason}
 	}
+
+	return &announceResult{
+		Interval:    time.Duration(trackerResp.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+		Warning:     trackerResp.WarningMessage,
+		TrackerId:   trackerResp.TrackerId,
+		Seeders:     trackerResp.Complete,
+		Leechers:    trackerResp.Incomplete,
+		Peers:       append(trackerResp.Peers, buildPeerInfo([]byte(trackerResp.Peers6), IPv6Len)...),
+	}, nil
 }
 
-func getPeersFromHTTPTrackers(trackerUrls []string, peerChan chan *PeerInfo) {
-	for _, trackerUrl := range trackerUrls {
-		go func(trackerUrl string) {
-			cli := &http.Client{Timeout: time.Duration(RetrievePeersTimeout) * time.Second}
-			resp, err := cli.Get(trackerUrl)
-			if err != nil {
-				fmt.Printf("failed to connect to tracker: %s error: %s\n", trackerUrl, err.Error())
-				return
-			}
-
-			trackerResp := new(HTTPTrackerResp)
-			err = bencode.Unmarshal(resp.Body, trackerResp)
-			resp.Body.Close()
-			if err != nil {
-				fmt.Printf("tracker %s response error: %s\n", trackerUrl, err.Error())
-				return
-			}
-
-			buildPeerInfo([]byte(trackerResp.Peers), peerChan)
-		}(trackerUrl)
-	}
+func (tr UDPTracker) String() string {
+	return "udp://" + net.JoinHostPort(tr.Host, strconv.Itoa(tr.Port))
 }
 
-func getPeersFromUDPTrackers(tf *TorrentFile, udpTrackers []UDPTracker, peerId [PeerIdLen]byte, peerChan chan *PeerInfo) {
-	for _, tr := range udpTrackers {
-		go connect(tf, tr, peerId, peerChan)
+// dial opens a socket to the tracker, looking up its IP if unknown. The
+// addresses of the host are tried in turn, IPv4 or IPv6, until one is
+// reachable.
+func (tr UDPTracker) dial() (*net.UDPConn, error) {
+	ips := []net.IP{tr.IP}
+	if tr.IP == nil {
+		var err error
+		ips, err = net.LookupIP(tr.Host)
+		if err != nil {
+			return nil, fmt.Errorf("host look up ip error: %v", err)
+		}
 	}
+	var err error
+	for _, ip := range ips {
+		var socket *net.UDPConn
+		socket, err = net.DialUDP("udp", nil, &net.UDPAddr{
+			IP:   ip,
+			Port: tr.Port,
+		})
+		if err == nil {
+			return socket, nil
+		}
+	}
+	return nil, fmt.Errorf("dial error: %v", err)
 }
 
-func connect(tf *TorrentFile, tracker UDPTracker, peerId [PeerIdLen]byte, peerChan chan *PeerInfo) {
-	socket, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   tracker.IP,
-		Port: tracker.Port,
-	})
+func (tr UDPTracker) announce(p announceParams) (*announceResult, error) {
+	socket, err := tr.dial()
 	if err != nil {
-		fmt.Printf("%v connect dial error: %v\n", tracker.Host, err)
-		return
+		return nil, err
 	}
 	defer func() { _ = socket.Close() }()
 
+	connId, err := udpConnect(socket)
+	if err != nil {
+		return nil, err
+	}
+	return udpAnnounce(socket, connId, p)
+}
+
+func udpConnect(socket *net.UDPConn) (uint64, error) {
 	// connect request:
 	// Offset  Size            Name            Value
 	// 0       64-bit integer  protocol_id     0x41727101980 // magic constant
 	// 8       32-bit integer  action          0 // connect
 	// 12      32-bit integer  transaction_id
 	// 16
+	transId := uint32(genTransactionID())
 	payload := make([]byte, 16)
 	binary.BigEndian.PutUint64(payload[0:8], uint64(UDPTrackerProtocolID))
 	binary.BigEndian.PutUint32(payload[8:12], uint32(ActionConnect))
-	binary.BigEndian.PutUint32(payload[12:16], uint32(genTransactionID()))
-	_, err = socket.Write(payload)
+	binary.BigEndian.PutUint32(payload[12:16], transId)
+	_, err := socket.Write(payload)
 	if err != nil {
-		fmt.Printf("%v connect write payload error: %v\n", tracker.Host, err)
-		return
+		return 0, fmt.Errorf("connect write payload error: %v", err)
 	}
 	data := make([]byte, 16)
 	_ = socket.SetReadDeadline(time.Now().Add(time.Duration(RetrievePeersTimeout) * time.Second))
-	n, remoteAddr, err := socket.ReadFromUDP(data)
+	n, err := socket.Read(data)
 	if err != nil {
-		fmt.Printf("%v connect read from udp error: %v\n", tracker.Host, err)
-		return
+		return 0, fmt.Errorf("connect read from udp error: %v", err)
 	}
 	// connect response:
 	// 0       32-bit integer  action          0 // connect
 	// 4       32-bit integer  transaction_id
 	// 8       64-bit integer  connection_id
 	// 16
-	if binary.BigEndian.Uint32(data[:4]) == ActionError {
-		fmt.Printf("%v connect response error\n", tracker.Host)
-		return
+	if n < 16 || binary.BigEndian.Uint32(data[:4]) != ActionConnect || binary.BigEndian.Uint32(data[4:8]) != transId {
+		return 0, errors.New("connect response error")
 	}
-
-	fmt.Printf("connect recv:%v addr:%v count:%v\n", data[:n], remoteAddr, n)
-	announce(tf, binary.BigEndian.Uint64(data[8:16]), peerId, tracker, peerChan)
+	return binary.BigEndian.Uint64(data[8:16]), nil
 }
 
-func announce(tf *TorrentFile, connId uint64, peerId [PeerIdLen]byte, tracker UDPTracker, peerChan chan *PeerInfo) {
-	socket, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   tracker.IP,
-		Port: tracker.Port,
-	})
-	localIPStr := strings.Split(socket.LocalAddr().String(), ":")
-	localPort, _ := strconv.Atoi(localIPStr[len(localIPStr)-1])
-	if err != nil {
-		fmt.Printf("%v announce dial error: %v\n", tracker.Host, err)
-		return
-	}
-	defer func() { _ = socket.Close() }()
-
+// udpAnnounce sends the announce request, p.port is the TCP port we accept
+// peers on, not the one of the UDP socket. The tracker answers IPv6 peers
+// when it's reached over IPv6.
+func udpAnnounce(socket *net.UDPConn, connId uint64, p announceParams) (*announceResult, error) {
 	// IPv4 announce request:
 	//
 	// Offset  Size    Name    Value
@@ -258,24 +403,24 @@ func announce(tf *TorrentFile, connId uint64, peerId [PeerIdLen]byte, tracker UD
 	// 98
 	key := 0x1a7e3d22
 	numWant := -1
+	transId := uint32(genTransactionID())
 	payload := make([]byte, 98)
 	binary.BigEndian.PutUint64(payload[0:8], connId)
 	binary.BigEndian.PutUint32(payload[8:12], uint32(ActionAnnounce))
-	binary.BigEndian.PutUint32(payload[12:16], uint32(genTransactionID()))
-	copy(payload[16:36], tf.InfoSHA[:])
-	copy(payload[36:56], peerId[:])
-	binary.BigEndian.PutUint64(payload[56:64], 0)
-	binary.BigEndian.PutUint64(payload[64:72], uint64(tf.FileLen))
-	binary.BigEndian.PutUint64(payload[72:80], 0)
-	binary.BigEndian.PutUint32(payload[80:84], 0)
+	binary.BigEndian.PutUint32(payload[12:16], transId)
+	copy(payload[16:36], p.infoSHA[:])
+	copy(payload[36:56], p.peerId[:])
+	binary.BigEndian.PutUint64(payload[56:64], uint64(p.downloaded))
+	binary.BigEndian.PutUint64(payload[64:72], uint64(p.left))
+	binary.BigEndian.PutUint64(payload[72:80], uint64(p.uploaded))
+	binary.BigEndian.PutUint32(payload[80:84], uint32(p.event))
 	binary.BigEndian.PutUint32(payload[84:88], 0)
 	binary.BigEndian.PutUint32(payload[88:92], uint32(key))
 	binary.BigEndian.PutUint32(payload[92:96], uint32(numWant))
-	binary.BigEndian.PutUint16(payload[96:98], uint16(localPort))
-	_, err = socket.Write(payload)
+	binary.BigEndian.PutUint16(payload[96:98], uint16(p.port))
+	_, err := socket.Write(payload)
 	if err != nil {
-		fmt.Printf("%v announce write payload error: %v\n", tracker.Host, err)
-		return
+		return nil, fmt.Errorf("announce write payload error: %v", err)
 	}
 	// IPv4 announce response:
 	//
@@ -287,33 +432,31 @@ func announce(tf *TorrentFile, connId uint64, peerId [PeerIdLen]byte, tracker UD
 	// 20 + 6 * n  32-bit integer  IP address
 	// 24 + 6 * n  16-bit integer  TCP port
 	// 20 + 6 * N
-	data := make([]byte, 1220) // 20 + 200 * 6
+	//
+	// the IPv6 one has 16-byte IP addresses, 18 bytes per peer
+	ipLen := IPLen
+	if socket.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		ipLen = IPv6Len
+	}
+	data := make([]byte, 20+200*(ipLen+PortLen))
 	_ = socket.SetReadDeadline(time.Now().Add(time.Duration(RetrievePeersTimeout) * time.Second))
-	n, remoteAddr, err := socket.ReadFromUDP(data)
+	n, err := socket.Read(data)
 	if err != nil {
-		fmt.Printf("%v announce read from udp error: %v\n", tracker.Host, err)
-		return
+		return nil, fmt.Errorf("announce read from udp error: %v", err)
 	}
-	if binary.BigEndian.Uint32(data[:4]) == ActionError {
-		fmt.Printf("%v announce response error\n", tracker.Host)
-		return
+	if n >= 8 && binary.BigEndian.Uint32(data[:4]) == ActionError && binary.BigEndian.Uint32(data[4:8]) == transId {
+		return nil, &TrackerFailure{Reason: string(data[8:n])}
 	}
-	fmt.Printf("announce recv:%v addr:%v count:%v\n", data[:n], remoteAddr, n)
-
-	// peers info
-	peerNum := (len(data) - 20) / 6
-	for i := 0; i < peerNum; i++ {
-		ip := make(net.IP, 4)
-		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(data[20+6*i:24+6*i]))
-		port := binary.BigEndian.Uint16(data[24+6*i : 26+6*i])
-		if port == 0 {
-			continue
-		}
-		peerChan <- &PeerInfo{
-			Ip:   ip,
-			Port: port,
-		}
+	if n < 20 || binary.BigEndian.Uint32(data[:4]) != ActionAnnounce || binary.BigEndian.Uint32(data[4:8]) != transId {
+		return nil, errors.New("announce response error")
 	}
+
+	return &announceResult{
+		Interval: time.Duration(binary.BigEndian.Uint32(data[8:12])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(data[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(data[16:20])),
+		Peers:    buildPeerInfo(data[20:n], ipLen),
+	}, nil
 }
 
 func isHTTPTrackerUrl(url string) bool {
@@ -2,7 +2,15 @@ package torrent
 
 import (
 	"crypto/rand"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestRetrievePeers(t *testing.T) {
@@ -12,5 +20,124 @@ func TestRetrievePeers(t *testing.T) {
 	_, _ = rand.Read(peerId[:])
 
 	peerMap := make(map[string]*PeerInfo)
-	RetrievePeers(tf, peerId, &peerMap)
+	RetrievePeers(tf, peerId, PeerPort, &peerMap)
+}
+
+// trackerServer answers every announce with resp, and sends the query of
+// each on queries
+func trackerServer(resp string, queries chan url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte(resp))
+	}))
+}
+
+func TestHTTPTrackerResp(t *testing.T) {
+	queries := make(chan url.Values, 8)
+	srv := trackerServer("d8:completei7e10:incompletei3e8:intervali1800e12:min intervali900e"+
+		"5:peersld2:ip8:10.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eed2:ip11:example.com4:porti1eed2:ip8:10.0.0.24:porti0eee"+
+		"10:tracker id3:abc15:warning message4:busye", queries)
+	defer srv.Close()
+
+	res, err := httpTracker(srv.URL).announce(announceParams{port: 6881})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &announceResult{
+		Interval:    30 * time.Minute,
+		MinInterval: 15 * time.Minute,
+		Warning:     "busy",
+		TrackerId:   "abc",
+		Seeders:     7,
+		Leechers:    3,
+		Peers:       []*PeerInfo{{Ip: net.IP{10, 0, 0, 1}, Port: 6881}},
+	}, res)
+	assert.Equal(t, "", nextQuery(t, queries).Get("trackerid"))
+
+	_, err = httpTracker(srv.URL).announce(announceParams{trackerId: "abc"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", nextQuery(t, queries).Get("trackerid"))
+}
+
+func TestHTTPTrackerFailure(t *testing.T) {
+	queries := make(chan url.Values, 8)
+	srv := trackerServer("d14:failure reason12:unregisterede", queries)
+	defer srv.Close()
+
+	_, err := httpTracker(srv.URL).announce(announceParams{})
+	var failure *TrackerFailure
+	assert.Equal(t, true, errors.As(err, &failure))
+	assert.Equal(t, "unregistered", failure.Reason)
+}
+
+func TestAnnounceTrackerId(t *testing.T) {
+	queries := make(chan url.Values, 8)
+	srv := trackerServer("d8:intervali3600e5:peers0:10:tracker id3:abce", queries)
+	defer srv.Close()
+	tf := newTestTorrent([]byte("some data"), 8, nil)
+	tf.Announce = srv.URL
+	an := NewAnnouncer(tf, tf.newTorrentTask(6881))
+
+	_, err := an.announce(EventNone)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", nextQuery(t, queries).Get("trackerid"))
+	_, err = an.announce(EventNone)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", nextQuery(t, queries).Get("trackerid"))
+}
+
+func TestNewTrackerIPv6(t *testing.T) {
+	tr, err := newTracker("udp://[2001:db8::1]:6969/announce")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, UDPTracker{Host: "2001:db8::1", Port: 6969}, tr)
+	assert.Equal(t, "udp://[2001:db8::1]:6969", tr.String())
+	_, err = newTracker("udp://[2001:db8::1]/announce")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestHTTPTrackerPeers6(t *testing.T) {
+	queries := make(chan url.Values, 8)
+	peers := compactPeer("10.0.0.1", 6881)
+	peers6 := compactPeer("2001:db8::1", 6882)
+	srv := trackerServer("d8:intervali60e5:peers6:"+peers+"6:peers618:"+peers6+"e", queries)
+	defer srv.Close()
+
+	res, err := httpTracker(srv.URL).announce(announceParams{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []*PeerInfo{
+		{Ip: net.IP{10, 0, 0, 1}, Port: 6881},
+		{Ip: net.ParseIP("2001:db8::1"), Port: 6882},
+	}, res.Peers)
+	assert.Equal(t, "[2001:db8::1]:6882", res.Peers[1].Addr())
+}
+
+func TestAnnounceUDPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("no IPv6: ", err)
+	}
+	defer conn.Close()
+	announces := make(chan udpAnnounceReq, 8)
+	go serveUDPTracker(conn, compactPeer("2001:db8::2", 51413)+compactPeer("2001:db8::3", 51414), announces)
+
+	tr, err := newTracker("udp://[::1]:" + strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port))
+	assert.Equal(t, nil, err)
+	res, err := tr.announce(announceParams{event: EventStarted, port: 6881})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, udpAnnounceReq{EventStarted, 6881}, <-announces)
+	assert.Equal(t, []*PeerInfo{
+		{Ip: net.ParseIP("2001:db8::2"), Port: 51413},
+		{Ip: net.ParseIP("2001:db8::3"), Port: 51414},
+	}, res.Peers)
+}
+
+func TestAddPeersSameIP(t *testing.T) {
+	tf := newTestTorrent([]byte("some data"), 8, nil)
+	task := tf.newTorrentTask(6881)
+	task.AddPeers([]*PeerInfo{
+		{Ip: net.IP{10, 0, 0, 1}, Port: 6881},
+		{Ip: net.IP{10, 0, 0, 1}, Port: 6882},
+		{Ip: net.IP{10, 0, 0, 1}, Port: 6881},
+		{Ip: net.ParseIP("2001:db8::1"), Port: 6881},
+	})
+	assert.Equal(t, 3, len(task.PeerMap))
+	assert.Equal(t, uint16(6881), task.PeerMap["[2001:db8::1]:6881"].Port)
 }
@@ -0,0 +1,73 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"runtime"
+	"sync"
+)
+
+// FileProgress tells how many bytes of a file belong to valid pieces
+type FileProgress struct {
+	File
+	Done int
+}
+
+// VerifyResult is what Verify found on disk
+type VerifyResult struct {
+	Bitfield Bitfield       // pieces whose data matches their SHA-1
+	Files    []FileProgress // completion of each file of the torrent
+}
+
+// Verify hashes the data already saved for a download to path, see
+// DownloadToFile for where it's looked for, and reports the valid pieces.
+// Pieces are hashed in parallel, one goroutine per CPU. Missing or short
+// files simply make the pieces they hold invalid.
+func (tf *TorrentFile) Verify(path string) (*VerifyResult, error) {
+	storage, err := OpenFileStorage(path, tf)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+
+	valid := make([]bool, len(tf.PieceSHA))
+	indexQueue := make(chan int, len(tf.PieceSHA))
+	for idx := range tf.PieceSHA {
+		indexQueue <- idx
+	}
+	close(indexQueue)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexQueue {
+				data, err := storage.ReadPiece(idx)
+				valid[idx] = err == nil && sha1.Sum(data) == tf.PieceSHA[idx]
+			}
+		}()
+	}
+	wg.Wait()
+
+	res := &VerifyResult{Bitfield: NewBitfield(len(tf.PieceSHA))}
+	for _, f := range storage.files {
+		res.Files = append(res.Files, FileProgress{File: File{Length: f.length}})
+	}
+	if tf.FileList == nil {
+		res.Files[0].Path = tf.FileName
+	}
+	for i, f := range tf.FileList {
+		res.Files[i].Path = f.Path
+	}
+	for idx, ok := range valid {
+		if !ok {
+			continue
+		}
+		res.Bitfield.SetPiece(idx)
+		begin, end, _ := pieceBounds(idx, tf.PieceLen, tf.FileLen)
+		_ = storage.files.spans(begin, end-begin, func(i, b, e int) error {
+			res.Files[i].Done += e - b
+			return nil
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,50 @@
+package torrent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("0123456789abcdef")
+	tf := newTestTorrent(data, 4, []File{{Length: 6, Path: "a"}, {Length: 6, Path: "b"}, {Length: 4, Path: "c"}})
+
+	// nothing on disk yet
+	res, err := tf.Verify(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, res.Bitfield.Count())
+	_, err = os.Stat(filepath.Join(dir, "name"))
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// a is complete, b has a bad byte in piece 2 and c is missing
+	assert.Equal(t, nil, os.MkdirAll(filepath.Join(dir, "name"), 0755))
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(dir, "name", "a"), data[0:6], 0644))
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(dir, "name", "b"), []byte("67x9ab"), 0644))
+
+	res, err = tf.Verify(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, res.Bitfield.Count())
+	assert.Equal(t, true, res.Bitfield.HasPiece(0))
+	assert.Equal(t, true, res.Bitfield.HasPiece(1)) // spans a and b
+	assert.Equal(t, []FileProgress{
+		{File: File{Length: 6, Path: "a"}, Done: 6},
+		{File: File{Length: 6, Path: "b"}, Done: 2},
+		{File: File{Length: 4, Path: "c"}, Done: 0},
+	}, res.Files)
+}
+
+func TestVerifySingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out")
+	data := []byte("0123456789")
+	tf := newTestTorrent(data, 4, nil)
+	tf.FileName = "single"
+	assert.Equal(t, nil, os.WriteFile(path, data, 0644))
+
+	res, err := tf.Verify(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, res.Bitfield.Count())
+	assert.Equal(t, []FileProgress{{File: File{Length: 10, Path: "single"}, Done: 10}}, res.Files)
+}